@@ -1,49 +1,137 @@
 package main
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 )
 
-// RunBackup creates a backup of the chosen database
+// backupOptions sets how a backup is made
+type backupOptions struct {
+	// Mask data with db/mask.json
+	sanitize bool
+	// Back up only these tables
+	tables []string
+}
+
+// RunBackup runs the backup subcommands
+// Expects:
+// - backup [mode] - creates a backup of the chosen database, then prunes old backups
+// - backup [mode] --sanitize - creates a backup with data masked by db/mask.json
+// - backup [mode] --tables users,pages - creates a backup of only the tables given
+// - backup prune [mode] [--dry-run] - deletes backups not kept by the retention settings
+// - backup list [mode] - lists the backups in the store for mode, newest first
+// - backup verify [mode|file] - checks the backup at file, or every backup in the store, against its manifest
+// Backups are kept in the store set by backup_store in config, see store.go
 func RunBackup(args []string) {
 	// Remove fragmenta backup from args list
-	args = args[2:]
+	args, flags := parseArgs(args[2:], "dry-run", "sanitize")
+
+	command := ""
+	if len(args) > 0 {
+		switch args[0] {
+		case "prune", "list", "verify":
+			command = args[0]
+			args = args[1:]
+		}
+	}
 
-	switch fragmentaConfig(args) {
-	case ModeProduction:
-		backupDB(ConfigProduction)
-	case ModeTest:
-		backupDB(ConfigTest)
+	// Verify takes a file or a mode
+	path := ""
+	if command == "verify" && len(args) > 0 && !isMode(args[0]) {
+		path = args[0]
+		args = args[1:]
+	}
+
+	mode := fragmentaConfig(args)
+	config := configForMode(mode)
+
+	store, err := backupStoreFor(config)
+	if err != nil {
+		log.Printf("Error running backup %s", err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "prune":
+		if !pruneBackups(config, flags["dry-run"] == "true") {
+			os.Exit(1)
+		}
+	case "list":
+		if !listBackups(store) {
+			os.Exit(1)
+		}
+	case "verify":
+		if !verifyBackups(store, path) {
+			os.Exit(1)
+		}
 	default:
-		backupDB(ConfigDevelopment)
+		options := backupOptions{sanitize: flags["sanitize"] == "true"}
+		if flags["tables"] != "" {
+			options.tables, err = parseTables(flags["tables"])
+			if err != nil {
+				log.Printf("Error running backup %s", err)
+				os.Exit(1)
+			}
+		}
+
+		// Only full backups are pruned
+		if backupDB(config, mode, store, options) && !options.sanitize && len(options.tables) == 0 {
+			pruneBackups(config, false)
+		}
 	}
 }
 
-// RunRestore restores the chosen database from a backup
+// RunRestore restores the chosen database from a backup,
+// the latest unless --file path or --at time is given.
+// With --tables users,pages only the rows in those tables are restored.
+// Backups from other modes are masked with db/mask.json.
 func RunRestore(args []string) {
-	// Remove fragmenta backup from args list
-	args = args[2:]
+	// Remove fragmenta restore from args list
+	args, flags := parseArgs(args[2:])
 
-	switch fragmentaConfig(args) {
-	case ModeProduction:
-		restoreDB(ConfigProduction)
-	case ModeTest:
-		restoreDB(ConfigTest)
-	default:
-		restoreDB(ConfigDevelopment)
+	mode := fragmentaConfig(args)
+	config := configForMode(mode)
+
+	store, err := backupStoreFor(config)
+	if err != nil {
+		log.Printf("Error running restore - %s", err)
+		return
+	}
+
+	var tables []string
+	if flags["tables"] != "" {
+		tables, err = parseTables(flags["tables"])
+		if err != nil {
+			log.Printf("Error running restore - %s", err)
+			return
+		}
+	}
+
+	path, cleanup, err := chooseBackup(store, flags["file"], flags["at"], len(tables) > 0)
+	if err != nil {
+		log.Printf("Error running restore - %s", err)
+		return
+	}
+
+	restored := restoreDB(config, mode, path, tables)
+	cleanup()
+	if !restored {
+		return
 	}
 
 	// Now that we have restored, run a post restore script if it exists
 	restore := "./bin/restore"
-	_, err := os.Stat(restore)
+	_, err = os.Stat(restore)
 	if err == nil {
 		log.Printf("Running restore script from " + restore)
-		mode := fragmentaConfig(args)
 		result, err := runCommand(restore, mode)
 		if err != nil {
 			log.Printf("Error running restore script %s", err)
@@ -54,90 +142,387 @@ func RunRestore(args []string) {
 
 }
 
-// restoreDB restores using pg_dump from the latest backup
-func restoreDB(config map[string]string) {
-	// Just assume it is psql for now
+// chooseBackup returns a local path for the backup to restore: file if set,
+// or the latest backup in store made at the time at (a prefix such as 2016-01-02 is enough),
+// or the latest backup in store if neither is set, downloading it if the store is not local.
+// Backups of some tables are only chosen from the store if partial is true, and sanitized backups never are.
+// The cleanup function removes any files downloaded.
+func chooseBackup(store backupStore, file string, at string, partial bool) (string, func(), error) {
+	if file != "" {
+		if !fileExists(file) {
+			return "", nil, fmt.Errorf("no backup found at %s", file)
+		}
+		return file, func() {}, nil
+	}
+
+	all, err := readBackups(store)
+	if err != nil {
+		return "", nil, err
+	}
+
+	b, err := matchBackup(at, restorableBackups(all, partial))
+	if err != nil {
+		return "", nil, fmt.Errorf("%s in %s", err, store)
+	}
+
+	if _, ok := store.(*localStore); !ok {
+		log.Printf("Downloading backup %s from %s", b.path, store)
+	}
+	return fetchBackup(store, b.path)
+}
+
+// restorableBackups returns the backups which may be chosen by time to restore, including partial
+// backups only if partial is true. Sanitized backups are only restored when chosen with --file,
+// as they would replace real data with masked data.
+func restorableBackups(all []backupFile, partial bool) []backupFile {
+	var backups []backupFile
+	for _, b := range all {
+		if (partial || !b.isPartial()) && !b.isSanitized() {
+			backups = append(backups, b)
+		}
+	}
+	return backups
+}
+
+// matchBackup returns the newest of backups (sorted newest first) whose time starts with at,
+// or the newest backup if at is empty
+func matchBackup(at string, backups []backupFile) (backupFile, error) {
+	for _, b := range backups {
+		if strings.HasPrefix(b.time.Format(backupTimeLayout), at) {
+			return b, nil
+		}
+	}
+
+	if at == "" {
+		return backupFile{}, fmt.Errorf("no backups found")
+	}
+	return backupFile{}, fmt.Errorf("no backup found at %s", at)
+}
+
+// listBackups prints the time, database, size and name of each backup in store, newest first
+func listBackups(store backupStore) bool {
+	backups, err := readBackups(store)
+	if err != nil {
+		log.Printf("Error reading backups %s", err)
+		return false
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "TIME\tDATABASE\tSIZE\tFILE\n")
+
+	for _, b := range backups {
+		db := b.db
+		if db == "" {
+			db = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.time.Format("2006-01-02 15:04"), db, formatSize(b.size), b.path)
+	}
+
+	w.Flush()
+	fmt.Printf("\n%d backups in %s\n", len(backups), store)
+	return true
+}
+
+// formatSize formats a size in bytes for display
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// restoreDB restores from the backup at path using the dialect for the db_adapter in config,
+// streaming the decompressed sql to the database so that it is never written to disk.
+// If the backup has a manifest, the archive is checked against it first.
+// If the backup was made in a mode other than mode, data is masked as it is restored.
+// If tables are given, or the backup contains only some tables, only the rows in those tables are replaced.
+// It returns true if the backup was restored.
+func restoreDB(config map[string]string, mode string, path string, tables []string) bool {
 	db := config["db"]
 
 	if len(db) == 0 {
 		log.Printf("Error running restore - no config")
-		return
+		return false
 	}
 
-	files, err := filepath.Glob("./db/backup/*.sql.gz")
+	log.Printf("Running restore for %s with %s", db, path)
+
+	manifest, err := readManifest(path)
 	if err != nil {
-		log.Printf("Error running restore - %s", err)
-		return
+		log.Printf("Error running restore %s", err)
+		return false
 	}
 
-	if len(files) == 0 {
-		log.Printf("Error running restore - no files")
-		return
+	if manifest != nil {
+		err = manifest.check(path)
+		if err != nil {
+			log.Printf("Error running restore %s", err)
+			return false
+		}
+
+		migrations, err := readMigrations()
+		if err == nil && manifest.newerMigration(migrations) {
+			log.Printf("WARNING: backup was made at migration %s, which is newer than the migrations in %s - the restored schema may not match this code", manifest.Migration, dbMigratePath("."))
+		}
+
+		if len(tables) == 0 {
+			tables = manifest.Tables
+		}
 	}
 
-	gz := files[len(files)-1:][0]
-	sql := strings.Trim(gz, ".gz")
+	if len(tables) > 0 {
+		log.Printf("Restoring rows in tables %s", strings.Join(tables, ","))
+	}
 
-	// Delete the sql file when we exit
-	defer os.Remove(sql)
+	m, err := restoreMasker(config, mode, path, manifest)
+	if err != nil {
+		log.Printf("Error running restore %s", err)
+		return false
+	}
 
-	log.Printf("Running restore for %s with %s", db, gz)
+	// Without a manifest there is no checksum, so check the archive is complete before restoring it
+	err = restoreArchive(config, path, m, tables, manifest == nil)
+	if err != nil {
+		log.Printf("Error running restore %s", err)
+		return false
+	}
 
-	// Unzip the file
-	result, err := runCommand("gzip", "-d", "-k", gz)
+	log.Printf("Restore complete to db %s with %s", db, path)
+	return true
+}
+
+// restoreArchive decompresses the gzipped sql at path into the database in config,
+// decrypting it first if it is encrypted, and masking it with m unless m is nil.
+// If tables are given, only the rows in those tables are restored.
+// If verify is true, the whole archive is decompressed first to check it is complete.
+func restoreArchive(config map[string]string, path string, m *masker, tables []string, verify bool) error {
+	encrypted, err := isEncrypted(path)
 	if err != nil {
-		log.Printf("Error running gz %s", err)
-		return
+		return err
 	}
-	log.Printf("%s", string(result))
 
-	// Create our psql command
-	result, err = runCommand("psql", "-d", db, "-f", sql)
+	var key []byte
+	if encrypted {
+		key, err = readBackupKey(false)
+		if err != nil {
+			return err
+		}
+
+		// Check the whole archive is authentic before restoring any of it
+		if !verify {
+			log.Printf("Verifying encrypted backup %s", path)
+			err = verifyEncrypted(path, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Decrypting the archive to check it is complete also checks it is authentic
+	if verify {
+		log.Printf("Verifying backup %s", path)
+		err = verifyArchive(path, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(path)
 	if err != nil {
-		log.Printf("Error running psql %s", err)
-		return
+		return err
+	}
+	defer f.Close()
+
+	var archive io.Reader = f
+	if encrypted {
+		archive, err = newDecryptReader(f, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	r, err := gzip.NewReader(archive)
+	if err != nil {
+		return err
 	}
-	log.Printf("%s", string(result))
+	defer r.Close()
 
-	log.Printf("Restore complete to db %s with %s", db, sql)
+	var sql io.Reader = r
+	d := dialectFor(config)
+	if len(tables) > 0 {
+		extracted := newTablesReader(sql, d.Name(), tables)
+		defer extracted.Close()
+		sql = extracted
+	}
+
+	if m != nil {
+		masked := newMaskReader(sql, m)
+		defer masked.Close()
+		sql = masked
+	}
+
+	return d.Restore(config, sql)
 }
 
-// backupDB backs up the db using the pg_dump binary
-// FIXME - look into alternatives using sql or adapters
-// we could have a backup/restore function on adapters?
-func backupDB(config map[string]string) {
+// verifyArchive decompresses the whole gzipped sql at path to check that it is complete,
+// without using the data, decrypting it first with key if key is set
+func verifyArchive(path string, key []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var archive io.Reader = f
+	if key != nil {
+		archive, err = newDecryptReader(f, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	r, err := gzip.NewReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// backupDB backs up the db using the dialect for the db_adapter in config,
+// streaming the sql through gzip so that only the archive is written to disk,
+// then writes a manifest of the archive beside it.
+// If backup_encrypt is yes in config, the archive is encrypted with the key in secrets.
+// If options.sanitize is true, data is masked with db/mask.json, and the archive is not encrypted
+// so that it can be shared. If options.tables are set, only those tables are backed up.
+// The archive and manifest are then put in store. It returns true if the backup was made and stored.
+func backupDB(config map[string]string, mode string, store backupStore, options backupOptions) bool {
 
-	// Just assume it is psql for now
-	adapter := "pg_dump"
 	db := config["db"]
 
 	if len(db) == 0 {
 		log.Println("Error running backup - no config")
-		return
+		return false
 	}
 
 	log.Printf("Running backup for %s", db)
 
-	date := time.Now().Format("2006-01-02-15-04")
-	dst := fmt.Sprintf("./db/backup/%s.sql", date)
+	var key []byte
+	var m *masker
+	var err error
+	name := backupName(config)
+	if len(options.tables) > 0 {
+		name += partialSuffix
+	}
 
-	// Create our psql command c for clean, f for file
-	result, err := runCommand(adapter, "-c", "-f", dst, db)
+	if options.sanitize {
+		m, err = sanitizeMasker(config)
+		if err != nil {
+			log.Printf("Error running backup %s", err)
+			return false
+		}
+		name += sanitizedSuffix
+	}
+
+	date := time.Now().Format(backupTimeLayout)
+	dst := stagingPath(store, fmt.Sprintf("%s-%s.sql.gz", date, name))
+
+	if !options.sanitize && config["backup_encrypt"] == "yes" {
+		key, err = readBackupKey(true)
+		if err != nil {
+			log.Printf("Error running backup %s", err)
+			return false
+		}
+		dst += encryptedExtension
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
 	if err != nil {
-		log.Printf("Error running psql %s", err)
-		return
+		log.Printf("Error running backup %s", err)
+		return false
 	}
-	log.Printf("%s", string(result))
 
-	// use compress/gzip instead?
-	result, err = runCommand("gzip", dst)
+	err = writeArchive(config, dst, options.tables, key, m)
 	if err != nil {
-		log.Printf("Error running gz %s", err)
-		return
+		// Remove any partial archive
+		os.Remove(dst)
+		log.Printf("Error running backup %s", err)
+		return false
+	}
+
+	err = writeManifest(config, dst, backupManifest{Mode: mode, Sanitized: options.sanitize, Tables: options.tables})
+	if err != nil {
+		log.Printf("Error writing backup manifest %s", err)
+		return false
 	}
-	log.Printf(string(result))
 
-	log.Printf("Backup complete of db %s", db)
+	err = storeBackup(store, dst)
+	if err != nil {
+		log.Printf("Error storing backup in %s %s", store, err)
+		return false
+	}
+
+	log.Printf("Backup complete of db %s to %s in %s", db, filepath.Base(dst), store)
+	return true
+}
+
+// writeArchive dumps the database in config (or only tables if given) as gzipped sql to the file at path,
+// encrypted with key unless key is nil, and masked with m unless m is nil
+func writeArchive(config map[string]string, path string, tables []string, key []byte, m *masker) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var archive io.WriteCloser = f
+	if key != nil {
+		archive, err = newEncryptWriter(f, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	w := gzip.NewWriter(archive)
+	if m != nil {
+		err = dumpMasked(config, tables, w, m)
+	} else {
+		err = dialectFor(config).Dump(config, tables, w)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// backupName returns the name of the database in config for backup file names,
+// for sqlite databases this is the file name without extension
+func backupName(config map[string]string) string {
+	name := filepath.Base(config["db"])
+	if dialectFor(config).Name() == AdapterSqlite {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
 }
 
 // fragmentaConfig returns the config set by args (development by default)
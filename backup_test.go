@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMatchBackup tests choosing a backup to restore by time
+func TestMatchBackup(t *testing.T) {
+	var backups []backupFile
+	for _, name := range []string{"2016-03-10-09-00", "2016-03-09-22-00", "2016-03-09-10-00"} {
+		bt, _ := time.Parse(backupTimeLayout, name)
+		backups = append(backups, backupFile{path: name + "-app.sql.gz", time: bt, db: "app"})
+	}
+
+	times := map[string]string{
+		"":                 "2016-03-10-09-00-app.sql.gz",
+		"2016-03-09":       "2016-03-09-22-00-app.sql.gz",
+		"2016-03-09-10-00": "2016-03-09-10-00-app.sql.gz",
+	}
+
+	for at, path := range times {
+		b, err := matchBackup(at, backups)
+		if err != nil || b.path != path {
+			t.Fatalf("Failed to match backup at:%s result:%s %s", at, b.path, err)
+		}
+	}
+
+	_, err := matchBackup("2016-04", backups)
+	if err == nil {
+		t.Fatalf("Failed to reject missing backup")
+	}
+}
+
+// TestRestorableBackups tests that sanitized backups, and partial backups unless restoring tables, are not chosen by time
+func TestRestorableBackups(t *testing.T) {
+	bt, _ := time.Parse(backupTimeLayout, "2016-03-10-09-00")
+	var all []backupFile
+	for i, db := range []string{"app-sanitized", "app-partial-sanitized", "app-partial", "app"} {
+		all = append(all, backupFile{path: db + ".sql.gz", time: bt.Add(-time.Duration(i) * time.Hour), db: db})
+	}
+
+	b, err := matchBackup("", restorableBackups(all, false))
+	if err != nil || b.db != "app" {
+		t.Fatalf("Failed to choose full backup result:%s %v", b.db, err)
+	}
+
+	b, err = matchBackup("2016-03-10-09", restorableBackups(all, true))
+	if err == nil {
+		t.Fatalf("Failed to skip sanitized backup at time result:%s", b.db)
+	}
+
+	b, err = matchBackup("", restorableBackups(all, true))
+	if err != nil || b.db != "app-partial" {
+		t.Fatalf("Failed to choose partial backup result:%s %v", b.db, err)
+	}
+}
+
+// TestBackupName tests naming backups after the database
+func TestBackupName(t *testing.T) {
+	if backupName(map[string]string{"db": "app_production"}) != "app_production" {
+		t.Fatalf("Failed to name postgres backup")
+	}
+
+	if backupName(map[string]string{"db_adapter": "sqlite3", "db": "db/app_development.sqlite"}) != "app_development" {
+		t.Fatalf("Failed to name sqlite backup")
+	}
+
+	if formatSize(512) != "512 B" || formatSize(1536) != "1.5 KB" || formatSize(3*1024*1024) != "3.0 MB" {
+		t.Fatalf("Failed to format sizes")
+	}
+}
+
+// TestVerifyArchive tests that truncated archives are found before restoring them
+func TestVerifyArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fragmenta-backup")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var archive bytes.Buffer
+	w := gzip.NewWriter(&archive)
+	for i := 0; i < 1000; i++ {
+		w.Write([]byte("INSERT INTO pages VALUES (1,'Page');\n"))
+	}
+	w.Close()
+
+	complete := filepath.Join(dir, "complete.sql.gz")
+	ioutil.WriteFile(complete, archive.Bytes(), 0644)
+	if err := verifyArchive(complete, nil); err != nil {
+		t.Fatalf("Failed to verify complete archive %s", err)
+	}
+
+	truncated := filepath.Join(dir, "truncated.sql.gz")
+	ioutil.WriteFile(truncated, archive.Bytes()[:archive.Len()/2], 0644)
+	if err := verifyArchive(truncated, nil); err == nil {
+		t.Fatalf("Failed to find truncated archive")
+	}
+}
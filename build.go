@@ -33,7 +33,8 @@ func buildServer(server string, env []string) error {
 	log.Printf("Running go fmt at %s", srcPath)
 	result, err := runCommand("go", "fmt", srcPath)
 	if err != nil {
-		log.Printf("Error running fmt %s", err)
+		// Show the syntax errors which stopped go fmt
+		log.Printf("Error running fmt %s\n%s", err, string(result))
 		return err
 	}
 	if len(result) > 0 {
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBuildServerSyntaxError tests that the errors from go fmt are shown when the server has a syntax error
+func TestBuildServerSyntaxError(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "fragmenta-build")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module app\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "server.go"), []byte("package main\n\nfunc main() {\n"), 0644)
+
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	err = buildServer(filepath.Join(dir, "server"), nil)
+	if err == nil {
+		t.Fatalf("Failed to return error for syntax error")
+	}
+	if !strings.Contains(output.String(), "server.go:3") {
+		t.Fatalf("Failed to show syntax error, output:\n%s", output.String())
+	}
+}
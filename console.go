@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fragmenta/query"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// consoleDB opens an interactive sql shell on the database in config, using the client
+// for the db_adapter with credentials passed in the environment, or the built in
+// console over the query package if the client is not installed.
+func consoleDB(config map[string]string) bool {
+	command, args, env := dialectFor(config).Console(config)
+
+	path, err := exec.LookPath(command)
+	if err != nil {
+		log.Printf("No %s client found, using the fragmenta console", command)
+		return runConsole(config, os.Stdin, os.Stdout)
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		log.Printf("Error running %s %s", command, err)
+		return false
+	}
+	return true
+}
+
+// runConsole reads sql statements ending in ; from in, runs them on the database in config,
+// and writes the results to out, until the input ends or \q is entered
+func runConsole(config map[string]string, in io.Reader, out io.Writer) bool {
+	err := openDatabase(config)
+	if err != nil {
+		log.Printf("Error opening database %s", err)
+		return false
+	}
+	defer query.CloseDatabase()
+
+	fmt.Fprintf(out, "Connected to db %s, end statements with ; and enter \\q to quit\n", config["db"])
+
+	scanner := bufio.NewScanner(in)
+	statement := ""
+	fmt.Fprintf(out, "%s> ", config["db"])
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if statement == "" && (line == `\q` || line == "quit" || line == "exit") {
+			break
+		}
+
+		statement = strings.TrimSpace(statement + "\n" + line)
+		if statement != "" && strings.HasSuffix(statement, ";") {
+			for _, s := range splitSQL(statement, dialectFor(config).Name()) {
+				err = consoleStatement(s, out)
+				if err != nil {
+					fmt.Fprintf(out, "ERROR: %s\n", err)
+				}
+			}
+			statement = ""
+		}
+
+		if statement == "" {
+			fmt.Fprintf(out, "%s> ", config["db"])
+		} else {
+			fmt.Fprintf(out, "%s-> ", config["db"])
+		}
+	}
+	fmt.Fprintln(out)
+
+	return scanner.Err() == nil
+}
+
+// consoleStatement runs one statement, printing the rows returned by queries,
+// or the number of rows affected by other statements
+func consoleStatement(statement string, out io.Writer) error {
+	if !returnsRows(statement) {
+		result, err := query.ExecSQL(statement)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err == nil {
+			fmt.Fprintf(out, "%d rows affected\n", n)
+		}
+		return nil
+	}
+
+	rows, err := query.QuerySQL(statement)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(cols))
+	pointers := make([]interface{}, len(cols))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\n", strings.Join(cols, "\t"))
+
+	count := 0
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return err
+		}
+
+		fields := make([]string, len(values))
+		for i, v := range values {
+			fields[i] = consoleValue(v)
+		}
+		fmt.Fprintf(w, "%s\n", strings.Join(fields, "\t"))
+		count++
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "(%d rows)\n", count)
+	return rows.Err()
+}
+
+// returnsRows returns true if statement is a query which returns rows
+func returnsRows(statement string) bool {
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch strings.ToUpper(strings.TrimSuffix(fields[0], ";")) {
+	case "SELECT", "WITH", "SHOW", "EXPLAIN", "VALUES", "PRAGMA", "DESCRIBE", "TABLE":
+		return true
+	}
+	return false
+}
+
+// consoleValue formats a value scanned from the database for display
+func consoleValue(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(value)
+	case time.Time:
+		return value.Format("2006-01-02 15:04:05")
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
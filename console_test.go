@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestReturnsRows tests choosing whether console statements are queries
+func TestReturnsRows(t *testing.T) {
+	statements := map[string]bool{
+		"SELECT * FROM pages;":                 true,
+		"select 1":                             true,
+		"WITH p AS (SELECT 1) SELECT * FROM p": true,
+		"PRAGMA table_info(pages);":            true,
+		"UPDATE pages SET name='a';":           false,
+		"DELETE FROM pages;":                   false,
+		"":                                     false,
+	}
+
+	for statement, expected := range statements {
+		if returnsRows(statement) != expected {
+			t.Fatalf("Failed to find rows for statement:%s", statement)
+		}
+	}
+}
+
+// TestConsoleValue tests formatting values for the console
+func TestConsoleValue(t *testing.T) {
+	values := map[interface{}]string{
+		nil:      "NULL",
+		int64(3): "3",
+		"text":   "text",
+		time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC): "2016-01-02 15:04:05",
+	}
+
+	for v, expected := range values {
+		if consoleValue(v) != expected {
+			t.Fatalf("Failed to format value:%v result:%s", v, consoleValue(v))
+		}
+	}
+
+	if consoleValue([]byte("bytes")) != "bytes" {
+		t.Fatalf("Failed to format bytes")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// The name of the file in secrets which holds the backup encryption key
+	backupKeyName = "backup.key"
+
+	// The extension added to encrypted backup archives
+	encryptedExtension = ".enc"
+
+	// The magic bytes at the start of encrypted archives, including the format version
+	encryptMagic = "FRAGENC1"
+
+	// The size of the random prefix for chunk nonces, stored after the magic bytes
+	encryptNoncePrefixSize = 7
+
+	// The size of plaintext chunks, each of which is sealed separately
+	encryptChunkSize = 64 * 1024
+)
+
+// errTampered is returned when an encrypted archive fails authentication
+var errTampered = errors.New("encrypted backup is corrupt or has been tampered with")
+
+// backupKeyPath returns the path of the backup encryption key
+func backupKeyPath(projectPath string) string {
+	return filepath.Join(secretsPath(projectPath), backupKeyName)
+}
+
+// readBackupKey reads the backup encryption key from secrets/backup.key, which holds
+// 32 hex encoded random bytes, creating the key first if create is true and it does not exist
+func readBackupKey(create bool) ([]byte, error) {
+	path := backupKeyPath(".")
+
+	if create && !fileExists(path) {
+		key := randomKey(32)
+		if key == "" {
+			return nil, fmt.Errorf("error generating backup key")
+		}
+		err := ioutil.WriteFile(path, []byte(key+"\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Generated backup key at %s - keep a copy of it safe, as backups cannot be restored without it", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading backup key %s", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid backup key at %s", path)
+	}
+
+	return key, nil
+}
+
+// isEncrypted returns true if the file at path starts with the encrypted archive magic bytes
+func isEncrypted(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(encryptMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return string(magic) == encryptMagic, nil
+}
+
+// newAEAD returns AES-256-GCM with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce for chunk i, made of the random prefix,
+// the chunk counter and a flag set on the last chunk, so that chunks
+// cannot be reordered, dropped or truncated without detection
+func chunkNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptNoncePrefixSize:], i)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts data written to it in sealed chunks
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	chunk  uint32
+	buf    []byte
+}
+
+// newEncryptWriter returns a writer which encrypts data to w with key,
+// Close must be called to write the final chunk
+func newEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encryptNoncePrefixSize)
+	_, err = io.ReadFull(rand.Reader, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(append([]byte(encryptMagic), prefix...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+// Write buffers p, sealing and writing each full chunk once more data follows it
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(e.buf) == encryptChunkSize {
+			err := e.seal(false)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		c := copy(e.buf[len(e.buf):encryptChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// Close seals and writes the last chunk, which may be empty
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// seal encrypts the buffered chunk and writes it
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.chunk, last), e.buf, []byte(encryptMagic))
+	e.chunk++
+	e.buf = e.buf[:0]
+
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts and authenticates chunks read from an encrypted archive
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	chunk  uint32
+	last   bool
+	buf    []byte
+	plain  []byte
+}
+
+// newDecryptReader returns a reader which decrypts the archive read from r with key.
+// Each chunk is authenticated before it is returned, and Read fails with errTampered
+// if any chunk has been changed, reordered or removed.
+func newDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptMagic)+encryptNoncePrefixSize)
+	_, err = io.ReadFull(r, header)
+	if err != nil || !bytes.HasPrefix(header, []byte(encryptMagic)) {
+		return nil, fmt.Errorf("not an encrypted backup")
+	}
+
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		prefix: header[len(encryptMagic):],
+		buf:    make([]byte, encryptChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// Read returns decrypted data, reading and opening the next chunk when needed
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.last {
+			// Nothing may follow the last chunk
+			_, err := d.r.Peek(1)
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, errTampered
+		}
+
+		err := d.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next chunk, which is the last if the archive ends after it
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.buf)
+	switch err {
+	case nil:
+		_, err = d.r.Peek(1)
+		d.last = (err == io.EOF)
+	case io.ErrUnexpectedEOF:
+		d.last = true
+	case io.EOF:
+		// The archive ended before the last chunk
+		return errTampered
+	default:
+		return err
+	}
+
+	plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.chunk, d.last), d.buf[:n], []byte(encryptMagic))
+	if err != nil {
+		return errTampered
+	}
+	d.chunk++
+	d.plain = plain
+	return nil
+}
+
+// verifyEncrypted decrypts the whole archive at path to check that it is authentic,
+// without using the data
+func verifyEncrypted(path string, key []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := newDecryptReader(f, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// encryptTest encrypts data with key, failing the test on error
+func encryptTest(t *testing.T, data []byte, key []byte) []byte {
+	var archive bytes.Buffer
+	w, err := newEncryptWriter(&archive, key)
+	if err != nil {
+		t.Fatalf("Failed to create encrypt writer %s", err)
+	}
+
+	// Write in uneven pieces to cross chunk boundaries
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err = w.Write(data[:n])
+		if err != nil {
+			t.Fatalf("Failed to encrypt %s", err)
+		}
+		data = data[n:]
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Failed to close encrypt writer %s", err)
+	}
+	return archive.Bytes()
+}
+
+// decryptTest decrypts archive with key
+func decryptTest(archive []byte, key []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(archive), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// TestEncryptRoundTrip tests encrypting and decrypting archives of different sizes
+func TestEncryptRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+
+	for _, size := range []int{0, 1, encryptChunkSize, encryptChunkSize*2 + encryptChunkSize/2} {
+		data := make([]byte, size)
+		io.ReadFull(rand.Reader, data)
+
+		archive := encryptTest(t, data, key)
+		if !bytes.HasPrefix(archive, []byte(encryptMagic)) {
+			t.Fatalf("Failed to write magic bytes for size:%d", size)
+		}
+
+		plain, err := decryptTest(archive, key)
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Fatalf("Failed to decrypt archive of size:%d %s", size, err)
+		}
+	}
+}
+
+// TestDecryptTampered tests that changed, truncated or wrongly keyed archives are rejected
+func TestDecryptTampered(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+
+	data := bytes.Repeat([]byte("INSERT INTO users VALUES (1);\n"), encryptChunkSize/10)
+	archive := encryptTest(t, data, key)
+
+	changed := append([]byte{}, archive...)
+	changed[len(changed)/2] ^= 1
+
+	chunk := encryptChunkSize + 16
+	header := len(encryptMagic) + encryptNoncePrefixSize
+	tests := map[string][]byte{
+		"changed":   changed,
+		"truncated": archive[:len(archive)-10],
+		"dropped":   archive[:header+chunk],
+		"appended":  append(append([]byte{}, archive...), 0),
+	}
+
+	for name, tampered := range tests {
+		_, err := decryptTest(tampered, key)
+		if err != errTampered {
+			t.Fatalf("Failed to reject %s archive result:%v", name, err)
+		}
+	}
+
+	wrong := make([]byte, 32)
+	_, err := decryptTest(archive, wrong)
+	if err != errTampered {
+		t.Fatalf("Failed to reject wrong key result:%v", err)
+	}
+}
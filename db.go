@@ -0,0 +1,217 @@
+package main
+
+import (
+	"github.com/fragmenta/query"
+	"log"
+	"os"
+)
+
+// RunDB runs the db subcommands
+// Expects:
+// - db schema [mode] - writes the schema of the database to db/schema.sql
+// - db schema [mode] --check - exits with an error if migrations are pending or db/schema.sql does not match the database
+// - db create [mode] [--migrate] [--seed] - creates the user and database, then optionally migrates and seeds it
+// - db drop [mode] - drops the database, and the user if no other mode uses it
+// - db reset [mode] - drops, creates, migrates and seeds the database
+// - db seed [mode] - loads the seed files in db/seeds/mode
+// - db console [mode] - opens an interactive sql shell on the database
+// Changing the production database requires --force.
+func RunDB(args []string) {
+	// Remove fragmenta db from args list
+	args, flags := parseArgs(args[2:], "check", "migrate", "seed", "force")
+
+	if len(args) == 0 {
+		log.Printf("Not enough arguments, you can use fragmenta db [schema|create|drop|reset|seed|console]")
+		return
+	}
+
+	command := args[0]
+	mode := fragmentaConfig(args[1:])
+	config := configForMode(mode)
+	options := migrateOptions{schema: mode == ModeDevelopment}
+
+	switch command {
+	case "create", "drop", "reset", "seed":
+		if mode == ModeProduction && flags["force"] != "true" {
+			log.Printf("Error - refusing to %s the production database without --force", command)
+			os.Exit(1)
+		}
+	}
+
+	switch command {
+	case "schema":
+		if !schemaDB(config, flags["check"] == "true") {
+			os.Exit(1)
+		}
+	case "create":
+		if !createDB(config) {
+			return
+		}
+		if flags["migrate"] == "true" || flags["seed"] == "true" {
+			if migrateDB(config, options) && flags["seed"] == "true" {
+				seedDB(config, mode)
+			}
+		}
+	case "drop":
+		dropDB(config)
+	case "reset":
+		if dropDB(config) && createDB(config) && migrateDB(config, options) {
+			seedDB(config, mode)
+		}
+	case "seed":
+		if !seedDB(config, mode) {
+			os.Exit(1)
+		}
+	case "console":
+		if !consoleDB(config) {
+			os.Exit(1)
+		}
+	default:
+		log.Printf("Sorry, I didn't recognise that argument, you can use fragmenta db [schema|create|drop|reset|seed|console]")
+	}
+}
+
+// schemaDB writes the schema of the database in config to db/schema.sql,
+// or if check is true compares it with db/schema.sql. It returns false on failure.
+func schemaDB(config map[string]string, check bool) bool {
+	err := openDatabase(config)
+	if err != nil {
+		log.Printf("Error opening database %s", err)
+		return false
+	}
+	defer query.CloseDatabase()
+
+	if !check {
+		err = writeSchema(config)
+		if err != nil {
+			log.Printf("Error writing schema %s", err)
+			return false
+		}
+		return true
+	}
+
+	err = checkSchema(config)
+	if err != nil {
+		log.Printf("Error checking schema - %s", err)
+		return false
+	}
+
+	log.Printf("Schema at %s matches db %s", dbSchemaPath("."), config["db"])
+	return true
+}
+
+// createDB creates the user in config if it does not exist, then the database owned by them,
+// connected to the admin database given by adminConfig. It returns true if the database was created.
+func createDB(config map[string]string) bool {
+	d := dialectFor(config)
+	db := config["db"]
+	user := config["db_user"]
+
+	sql := d.CreateDatabaseSQL(db, user)
+	if sql == "" {
+		// The database is created when it is first opened
+		err := openDatabase(config)
+		if err != nil {
+			log.Printf("Error creating database %s", err)
+			return false
+		}
+		query.CloseDatabase()
+		log.Printf("Created database %s", db)
+		return true
+	}
+
+	err := openDatabase(adminConfig(config))
+	if err != nil {
+		log.Printf("Error opening admin database %s", err)
+		return false
+	}
+	defer query.CloseDatabase()
+
+	exists, err := userExists(d, user)
+	if err != nil {
+		log.Printf("Error finding user %s", err)
+		return false
+	}
+
+	var statements []string
+	if exists {
+		log.Printf("User %s exists", user)
+	} else {
+		statements = append(statements, splitSQL(d.CreateUserSQL(user, config["db_pass"]), d.Name())...)
+	}
+	statements = append(statements, splitSQL(sql, d.Name())...)
+
+	// Databases cannot be created within a transaction
+	err = execStatements(statements, false)
+	if err != nil {
+		log.Printf("Error creating database %s", err)
+		return false
+	}
+
+	log.Printf("Created database %s for user %s", db, user)
+	return true
+}
+
+// dropDB drops the database in config, connected to the admin database given by adminConfig,
+// along with its user unless that is the admin user or is used by another mode.
+// It returns true if the database was dropped or did not exist.
+func dropDB(config map[string]string) bool {
+	d := dialectFor(config)
+	db := config["db"]
+	user := config["db_user"]
+
+	sql := d.DropDatabaseSQL(db)
+	if sql == "" {
+		err := os.Remove(db)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error dropping database %s", err)
+			return false
+		}
+		log.Printf("Dropped database %s", db)
+		return true
+	}
+
+	admin := adminConfig(config)
+	err := openDatabase(admin)
+	if err != nil {
+		log.Printf("Error opening admin database %s", err)
+		return false
+	}
+	defer query.CloseDatabase()
+
+	statements := splitSQL(sql, d.Name())
+	if user == admin["db_user"] || sharedUser(config) {
+		log.Printf("Keeping user %s, which is used by other databases", user)
+	} else {
+		statements = append(statements, splitSQL(d.DropUserSQL(user), d.Name())...)
+	}
+
+	err = execStatements(statements, false)
+	if err != nil {
+		log.Printf("Error dropping database %s", err)
+		return false
+	}
+
+	log.Printf("Dropped database %s", db)
+	return true
+}
+
+// userExists returns true if the user exists, using the open admin database
+func userExists(d dialect, user string) (bool, error) {
+	rows, err := query.QuerySQL(d.UserExistsSQL(user))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// sharedUser returns true if the db_user in config is used by the database for another mode
+func sharedUser(config map[string]string) bool {
+	for _, c := range []map[string]string{ConfigDevelopment, ConfigTest, ConfigProduction} {
+		if c["db"] != config["db"] && c["db_user"] == config["db_user"] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestSharedUser tests finding users shared between modes, which are kept when dropping a database
+func TestSharedUser(t *testing.T) {
+	ConfigDevelopment = map[string]string{"db": "app_development", "db_user": "app_server"}
+	ConfigTest = map[string]string{"db": "app_test", "db_user": "app_server"}
+	ConfigProduction = map[string]string{"db": "app_production", "db_user": "app_production"}
+	defer func() {
+		ConfigDevelopment, ConfigTest, ConfigProduction = nil, nil, nil
+	}()
+
+	if !sharedUser(ConfigTest) {
+		t.Fatalf("Failed to find user shared with development")
+	}
+
+	if sharedUser(ConfigProduction) {
+		t.Fatalf("Failed to find user used only by production")
+	}
+}
@@ -45,8 +45,13 @@ func RunDeploy(args []string) {
 // buildAssets compiles the app assets before a deploy, so that they're available for production use
 func buildAssets() {
 	log.Printf("Compiling assets...")
-	err := assets.New(true).Compile("src", "public")
+	err := compileAssets(true)
 	if err != nil {
 		log.Fatalf("#error compiling assets %s", err)
 	}
 }
+
+// compileAssets compiles the assets in src into public, minified and combined if compiled is true
+func compileAssets(compiled bool) error {
+	return assets.New(compiled).Compile("src", "public")
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fragmenta/query"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Adapters used for db_adapter in config, these match the adapters in the query package
+const (
+	AdapterPostgres = "postgres"
+	AdapterMysql    = "mysql"
+	AdapterSqlite   = "sqlite3"
+)
+
+// dialect describes the sql and tools used for one database adapter
+type dialect interface {
+	// Name returns the adapter name used by the query package
+	Name() string
+
+	// Placeholder returns the placeholder for query argument i (counting from 1)
+	Placeholder(i int) string
+
+	// SQLType converts a user-defined type to a column type
+	SQLType(fieldType string) string
+
+	// PrimaryKeySQL returns the column definition for an id primary key
+	PrimaryKeySQL() string
+
+	// OwnerSQL returns sql to set the owner of a table, or "" if not supported
+	OwnerSQL(table string, user string) string
+
+	// CreateUserSQL returns sql to create the database user, or "" if there are no users
+	CreateUserSQL(user string, password string) string
+
+	// UserExistsSQL returns a query which returns a row if the user exists, or "" if there are no users
+	UserExistsSQL(user string) string
+
+	// DropUserSQL returns sql to drop the database user if it exists, or "" if there are no users
+	DropUserSQL(user string) string
+
+	// TableExistsSQL returns a query which returns a row if the table exists in the open database
+	TableExistsSQL(table string) string
+
+	// CreateDatabaseSQL returns sql to create the database for the user,
+	// or "" if the database need not be created
+	CreateDatabaseSQL(db string, user string) string
+
+	// DropDatabaseSQL returns sql to drop the database if it exists,
+	// or "" if the database is a file
+	DropDatabaseSQL(db string) string
+
+	// AddColumnSQL returns sql to add a column if it is missing,
+	// or "" if this cannot be done in sql alone
+	AddColumnSQL(table string, column string, columnType string) string
+
+	// ResetSequenceSQL returns sql to set the sequence for an id column after rows are
+	// inserted with explicit ids, or "" if the database does this itself
+	ResetSequenceSQL(table string, column string) string
+
+	// AdminDatabase returns the database to connect to when creating databases
+	AdminDatabase() string
+
+	// Dump writes a backup of the database in config as sql to w,
+	// of only the tables given if there are any
+	Dump(config map[string]string, tables []string, w io.Writer) error
+
+	// Restore loads the sql backup read from r into the database in config
+	Restore(config map[string]string, r io.Reader) error
+
+	// Schema returns sql to create the schema of the open database in config,
+	// without data, owners or the fragmenta tables
+	Schema(config map[string]string) (string, error)
+
+	// Console returns the interactive client command for the database in config,
+	// with its arguments and the environment to run it with, including credentials
+	Console(config map[string]string) (string, []string, []string)
+}
+
+// dialectFor returns the dialect for the db_adapter set in config (postgres by default)
+func dialectFor(config map[string]string) dialect {
+	switch config["db_adapter"] {
+	case AdapterMysql:
+		return &mysqlDialect{}
+	case AdapterSqlite, "sqlite":
+		return &sqliteDialect{}
+	default:
+		return &postgresDialect{}
+	}
+}
+
+// postgresDialect uses postgresql and its client tools psql and pg_dump
+type postgresDialect struct{}
+
+// Name returns the adapter name
+func (d *postgresDialect) Name() string {
+	return AdapterPostgres
+}
+
+// Placeholder returns $1, $2 etc
+func (d *postgresDialect) Placeholder(i int) string {
+	return fmt.Sprintf("$%d", i)
+}
+
+// SQLType converts a user-defined type to a postgres column type
+func (d *postgresDialect) SQLType(fieldType string) string {
+	switch fieldType {
+	case "text", "string", "char(255)":
+		return "text"
+	case "int", "int64", "integer", "bigint":
+		return "integer"
+	case "timestamp", "time", "datetime", "date":
+		return "timestamp"
+	case "float":
+		return "real"
+	case "double":
+		return "double precision"
+	default:
+		return fieldType
+	}
+}
+
+// PrimaryKeySQL returns a serial id column
+func (d *postgresDialect) PrimaryKeySQL() string {
+	return "id SERIAL NOT NULL"
+}
+
+// OwnerSQL returns sql to set the table owner
+func (d *postgresDialect) OwnerSQL(table string, user string) string {
+	return fmt.Sprintf("ALTER TABLE %s OWNER TO %s;\n", table, user)
+}
+
+// CreateUserSQL returns sql to create the user with a password
+func (d *postgresDialect) CreateUserSQL(user string, password string) string {
+	return fmt.Sprintf("CREATE USER \"%s\" WITH PASSWORD '%s';", user, password)
+}
+
+// UserExistsSQL returns a query for the user role
+func (d *postgresDialect) UserExistsSQL(user string) string {
+	return fmt.Sprintf("SELECT 1 FROM pg_roles WHERE rolname=%s;", quoteSQL(user))
+}
+
+// TableExistsSQL returns a query for the table in the current schema
+func (d *postgresDialect) TableExistsSQL(table string) string {
+	return fmt.Sprintf("SELECT 1 FROM information_schema.tables WHERE table_schema=current_schema() AND table_name=%s;", quoteSQL(table))
+}
+
+// DropUserSQL returns sql to drop the user role
+func (d *postgresDialect) DropUserSQL(user string) string {
+	return fmt.Sprintf("DROP USER IF EXISTS \"%s\";", user)
+}
+
+// CreateDatabaseSQL returns sql to create the database owned by the user
+func (d *postgresDialect) CreateDatabaseSQL(db string, user string) string {
+	return fmt.Sprintf("CREATE DATABASE \"%s\" WITH OWNER \"%s\";", db, user)
+}
+
+// DropDatabaseSQL returns sql to drop the database
+func (d *postgresDialect) DropDatabaseSQL(db string) string {
+	return fmt.Sprintf("DROP DATABASE IF EXISTS \"%s\";", db)
+}
+
+// AddColumnSQL returns sql to add a column if it does not exist
+func (d *postgresDialect) AddColumnSQL(table string, column string, columnType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;\n", table, column, columnType)
+}
+
+// ResetSequenceSQL returns sql to set the serial sequence for column to its maximum value
+func (d *postgresDialect) ResetSequenceSQL(table string, column string) string {
+	return fmt.Sprintf("SELECT setval(pg_get_serial_sequence(%s, %s), MAX(%s)) FROM %s HAVING MAX(%s) IS NOT NULL;", quoteSQL(table), quoteSQL(column), column, table, column)
+}
+
+// AdminDatabase returns the default postgres database
+func (d *postgresDialect) AdminDatabase() string {
+	return "postgres"
+}
+
+// Dump backs up the database using pg_dump, with c for clean
+func (d *postgresDialect) Dump(config map[string]string, tables []string, w io.Writer) error {
+	args := []string{"-c"}
+	for _, t := range tables {
+		args = append(args, "-t", t)
+	}
+
+	result, err := runCommandStream(nil, nil, w, "pg_dump", append(args, config["db"])...)
+	if err != nil {
+		return fmt.Errorf("error running pg_dump %s\n%s", err, string(result))
+	}
+	log.Printf("%s", string(result))
+	return nil
+}
+
+// Restore loads the backup using psql
+func (d *postgresDialect) Restore(config map[string]string, r io.Reader) error {
+	result, err := runCommandStream(nil, r, nil, "psql", "-d", config["db"])
+	if err != nil {
+		return fmt.Errorf("error running psql %s\n%s", err, string(result))
+	}
+	log.Printf("%s", string(result))
+	return nil
+}
+
+// Schema dumps the schema using pg_dump, without session settings
+func (d *postgresDialect) Schema(config map[string]string) (string, error) {
+	result, err := runCommand("pg_dump", "--schema-only", "--no-owner", "--no-privileges", "--exclude-table=fragmenta_metadata", "--exclude-table=fragmenta_locks", config["db"])
+	if err != nil {
+		return "", fmt.Errorf("error running pg_dump %s\n%s", err, string(result))
+	}
+	return normalizeSchema(string(result)), nil
+}
+
+// Console returns psql, with the connection set in the environment
+func (d *postgresDialect) Console(config map[string]string) (string, []string, []string) {
+	env := append(os.Environ(), "PGDATABASE="+config["db"], "PGUSER="+config["db_user"], "PGPASSWORD="+config["db_pass"])
+	return "psql", nil, env
+}
+
+// mysqlDialect uses mysql and its client tools mysql and mysqldump
+type mysqlDialect struct{}
+
+// Name returns the adapter name
+func (d *mysqlDialect) Name() string {
+	return AdapterMysql
+}
+
+// Placeholder returns ?
+func (d *mysqlDialect) Placeholder(i int) string {
+	return "?"
+}
+
+// SQLType converts a user-defined type to a mysql column type
+func (d *mysqlDialect) SQLType(fieldType string) string {
+	switch fieldType {
+	case "text", "string", "char(255)":
+		return "text"
+	case "int", "int64", "integer", "bigint":
+		return "int"
+	case "timestamp", "time", "datetime", "date":
+		return "datetime"
+	case "float":
+		return "float"
+	case "double":
+		return "double"
+	default:
+		return fieldType
+	}
+}
+
+// PrimaryKeySQL returns an auto increment id column
+func (d *mysqlDialect) PrimaryKeySQL() string {
+	return "id int NOT NULL AUTO_INCREMENT PRIMARY KEY"
+}
+
+// OwnerSQL returns "" as mysql tables have no owner
+func (d *mysqlDialect) OwnerSQL(table string, user string) string {
+	return ""
+}
+
+// CreateUserSQL returns sql to create the user for local connections
+func (d *mysqlDialect) CreateUserSQL(user string, password string) string {
+	return fmt.Sprintf("CREATE USER '%s'@'localhost' IDENTIFIED BY '%s';", user, password)
+}
+
+// UserExistsSQL returns a query for the user in the mysql system database
+func (d *mysqlDialect) UserExistsSQL(user string) string {
+	return fmt.Sprintf("SELECT 1 FROM mysql.user WHERE user=%s;", quoteSQL(user))
+}
+
+// TableExistsSQL returns a query for the table in the current database
+func (d *mysqlDialect) TableExistsSQL(table string) string {
+	return fmt.Sprintf("SELECT 1 FROM information_schema.tables WHERE table_schema=DATABASE() AND table_name=%s;", quoteSQL(table))
+}
+
+// DropUserSQL returns sql to drop the user for local connections
+func (d *mysqlDialect) DropUserSQL(user string) string {
+	return fmt.Sprintf("DROP USER IF EXISTS '%s'@'localhost';", user)
+}
+
+// CreateDatabaseSQL returns sql to create the database, and grant the user access to it
+func (d *mysqlDialect) CreateDatabaseSQL(db string, user string) string {
+	return fmt.Sprintf("CREATE DATABASE `%s`;\nGRANT ALL PRIVILEGES ON `%s`.* TO '%s'@'localhost';", db, db, user)
+}
+
+// DropDatabaseSQL returns sql to drop the database
+func (d *mysqlDialect) DropDatabaseSQL(db string) string {
+	return fmt.Sprintf("DROP DATABASE IF EXISTS `%s`;", db)
+}
+
+// AddColumnSQL returns "" as mysql cannot add a column only if it is missing
+func (d *mysqlDialect) AddColumnSQL(table string, column string, columnType string) string {
+	return ""
+}
+
+// ResetSequenceSQL returns "" as mysql auto increment follows inserted ids
+func (d *mysqlDialect) ResetSequenceSQL(table string, column string) string {
+	return ""
+}
+
+// AdminDatabase returns the mysql system database
+func (d *mysqlDialect) AdminDatabase() string {
+	return "mysql"
+}
+
+// Dump backs up the database using mysqldump, passing the password in the environment
+func (d *mysqlDialect) Dump(config map[string]string, tables []string, w io.Writer) error {
+	// Column names are included in inserts so that backups can be masked
+	args := []string{"--user=" + config["db_user"], "--add-drop-table", "--complete-insert", config["db"]}
+	result, err := runCommandStream(mysqlEnv(config), nil, w, "mysqldump", append(args, tables...)...)
+	if err != nil {
+		return fmt.Errorf("error running mysqldump %s\n%s", err, string(result))
+	}
+	log.Printf("%s", string(result))
+	return nil
+}
+
+// Restore loads the backup using the mysql client
+func (d *mysqlDialect) Restore(config map[string]string, r io.Reader) error {
+	result, err := runCommandStream(mysqlEnv(config), r, nil, "mysql", "--user="+config["db_user"], config["db"])
+	if err != nil {
+		return fmt.Errorf("error running mysql %s\n%s", err, string(result))
+	}
+	log.Printf("%s", string(result))
+	return nil
+}
+
+// Schema dumps the schema using mysqldump, without session settings or auto increment counters
+func (d *mysqlDialect) Schema(config map[string]string) (string, error) {
+	result, err := runCommandEnv(mysqlEnv(config), "mysqldump", "--user="+config["db_user"], "--no-data", "--skip-comments", "--skip-add-drop-table",
+		"--ignore-table="+config["db"]+".fragmenta_metadata", "--ignore-table="+config["db"]+".fragmenta_locks", config["db"])
+	if err != nil {
+		return "", fmt.Errorf("error running mysqldump %s\n%s", err, string(result))
+	}
+	return normalizeSchema(mysqlAutoIncrement.ReplaceAllString(string(result), "")), nil
+}
+
+// Console returns the mysql client, with the password set in the environment
+func (d *mysqlDialect) Console(config map[string]string) (string, []string, []string) {
+	return "mysql", []string{"--user=" + config["db_user"], config["db"]}, mysqlEnv(config)
+}
+
+// mysqlAutoIncrement matches the auto increment counter in mysql table options
+var mysqlAutoIncrement = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// mysqlEnv returns the environment for running mysql client tools
+func mysqlEnv(config map[string]string) []string {
+	return append(os.Environ(), "MYSQL_PWD="+config["db_pass"])
+}
+
+// sqliteDialect uses a local sqlite database file at the path set in db,
+// backups are made through the query package, so no client tools are required
+type sqliteDialect struct{}
+
+// Name returns the adapter name
+func (d *sqliteDialect) Name() string {
+	return AdapterSqlite
+}
+
+// Placeholder returns ?
+func (d *sqliteDialect) Placeholder(i int) string {
+	return "?"
+}
+
+// SQLType converts a user-defined type to an sqlite column type
+func (d *sqliteDialect) SQLType(fieldType string) string {
+	switch fieldType {
+	case "text", "string", "char(255)":
+		return "text"
+	case "int", "int64", "integer", "bigint":
+		return "integer"
+	case "timestamp", "time", "datetime", "date":
+		return "timestamp"
+	case "float", "double":
+		return "real"
+	default:
+		return fieldType
+	}
+}
+
+// PrimaryKeySQL returns an autoincrementing integer id column
+func (d *sqliteDialect) PrimaryKeySQL() string {
+	return "id INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+// OwnerSQL returns "" as sqlite tables have no owner
+func (d *sqliteDialect) OwnerSQL(table string, user string) string {
+	return ""
+}
+
+// CreateUserSQL returns "" as sqlite has no users
+func (d *sqliteDialect) CreateUserSQL(user string, password string) string {
+	return ""
+}
+
+// UserExistsSQL returns "" as sqlite has no users
+func (d *sqliteDialect) UserExistsSQL(user string) string {
+	return ""
+}
+
+// TableExistsSQL returns a query for the table in sqlite_master
+func (d *sqliteDialect) TableExistsSQL(table string) string {
+	return fmt.Sprintf("SELECT 1 FROM sqlite_master WHERE type='table' AND name=%s;", quoteSQL(table))
+}
+
+// DropUserSQL returns "" as sqlite has no users
+func (d *sqliteDialect) DropUserSQL(user string) string {
+	return ""
+}
+
+// CreateDatabaseSQL returns "" as the database file is created when it is opened
+func (d *sqliteDialect) CreateDatabaseSQL(db string, user string) string {
+	return ""
+}
+
+// DropDatabaseSQL returns "" as the database is a file
+func (d *sqliteDialect) DropDatabaseSQL(db string) string {
+	return ""
+}
+
+// AddColumnSQL returns "" as sqlite cannot add a column only if it is missing
+func (d *sqliteDialect) AddColumnSQL(table string, column string, columnType string) string {
+	return ""
+}
+
+// ResetSequenceSQL returns "" as sqlite autoincrement follows inserted ids
+func (d *sqliteDialect) ResetSequenceSQL(table string, column string) string {
+	return ""
+}
+
+// AdminDatabase returns "" as there is no admin database
+func (d *sqliteDialect) AdminDatabase() string {
+	return ""
+}
+
+// Dump writes the schema and data of the database as sql
+func (d *sqliteDialect) Dump(config map[string]string, tables []string, w io.Writer) error {
+	err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer query.CloseDatabase()
+
+	b := bufio.NewWriter(w)
+	err = dumpSQLite(b, tables)
+	if err != nil {
+		return err
+	}
+	return b.Flush()
+}
+
+// Restore executes the sql backup against the database
+func (d *sqliteDialect) Restore(config map[string]string, r io.Reader) error {
+	sql, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	err = openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer query.CloseDatabase()
+
+	// The sqlite driver executes every statement in the sql, including triggers
+	_, err = query.ExecSQL(string(sql))
+	return err
+}
+
+// Schema reads the sql for each table, index, view and trigger from sqlite_master
+func (d *sqliteDialect) Schema(config map[string]string) (string, error) {
+	objects, err := readSQLiteObjects()
+	if err != nil {
+		return "", err
+	}
+
+	schema := ""
+	for _, o := range objects {
+		if strings.HasPrefix(o.name, "fragmenta_") {
+			continue
+		}
+		schema += o.sql + ";\n\n"
+	}
+
+	return schema, nil
+}
+
+// Console returns the sqlite3 client for the database file
+func (d *sqliteDialect) Console(config map[string]string) (string, []string, []string) {
+	return "sqlite3", []string{config["db"]}, os.Environ()
+}
+
+// normalizeSchema removes comments, session settings and client commands from a schema dump,
+// and collapses blank lines, so that only the schema itself remains
+func normalizeSchema(sql string) string {
+	var lines []string
+	blank := true
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		switch {
+		case strings.HasPrefix(line, "--"), strings.HasPrefix(line, "SET "), strings.HasPrefix(line, "/*!"),
+			strings.HasPrefix(line, "SELECT pg_catalog.set_config"), strings.HasPrefix(line, "\\"):
+			continue
+		case line == "":
+			if !blank {
+				lines = append(lines, line)
+			}
+			blank = true
+		default:
+			lines = append(lines, line)
+			blank = false
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")) + "\n"
+}
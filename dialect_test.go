@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDialectFor tests choosing a dialect from the db_adapter in config
+func TestDialectFor(t *testing.T) {
+	adapters := map[string]string{
+		"":         AdapterPostgres,
+		"postgres": AdapterPostgres,
+		"mysql":    AdapterMysql,
+		"sqlite3":  AdapterSqlite,
+		"sqlite":   AdapterSqlite,
+	}
+
+	for adapter, name := range adapters {
+		d := dialectFor(map[string]string{"db_adapter": adapter})
+		if d.Name() != name {
+			t.Fatalf("Failed to find dialect for adapter:%s to:%s result:%s", adapter, name, d.Name())
+		}
+	}
+
+	if (&sqliteDialect{}).CreateDatabaseSQL("db", "user") != "" {
+		t.Fatalf("Failed to skip database creation for sqlite")
+	}
+
+	if (&postgresDialect{}).DropDatabaseSQL("app_test") != `DROP DATABASE IF EXISTS "app_test";` || (&sqliteDialect{}).DropDatabaseSQL("db/app.sqlite") != "" {
+		t.Fatalf("Failed to drop database")
+	}
+
+	if (&sqliteDialect{}).TableExistsSQL("fragmenta_metadata") != "SELECT 1 FROM sqlite_master WHERE type='table' AND name='fragmenta_metadata';" {
+		t.Fatalf("Failed to query table for sqlite")
+	}
+
+	if (&mysqlDialect{}).SQLType("timestamp") != "datetime" {
+		t.Fatalf("Failed to convert type for mysql")
+	}
+}
+
+// literalTests maps values scanned from the database to sql literals
+var literalTests = map[interface{}]string{
+	nil:       "NULL",
+	int64(42): "42",
+	1.5:       "1.5",
+	true:      "1",
+	"it's":    "'it''s'",
+	time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC): "'2016-01-02 15:04:05+00:00'",
+}
+
+// TestSQLLiteral tests formatting values as sql literals for dumps
+func TestSQLLiteral(t *testing.T) {
+	for k, v := range literalTests {
+		if sqlLiteral(k) != v {
+			t.Fatalf("Failed to format literal:%v to:%s result:%s", k, v, sqlLiteral(k))
+		}
+	}
+
+	if sqlLiteral([]byte("text")) != "'text'" || sqlLiteral([]byte{0, 1}) != "X'0001'" {
+		t.Fatalf("Failed to format bytes as literals")
+	}
+}
+
+// TestNormalizeSchema tests removing comments and settings from schema dumps
+func TestNormalizeSchema(t *testing.T) {
+	dump := "--\n-- PostgreSQL database dump\n--\n\nSET statement_timeout = 0;\nSELECT pg_catalog.set_config('search_path', '', false);\n\\restrict abc\n\n\nCREATE TABLE public.pages (\n    id integer NOT NULL\n);   \n\n\n\nCREATE INDEX pages_id ON public.pages (id);\n\n"
+	expected := "CREATE TABLE public.pages (\n    id integer NOT NULL\n);\n\nCREATE INDEX pages_id ON public.pages (id);\n"
+
+	schema := normalizeSchema(dump)
+	if schema != expected {
+		t.Fatalf("Failed to normalize schema result:\n%s", schema)
+	}
+}
@@ -11,16 +11,37 @@ The following subcommands are available when using the command line fragmenta to
     ------
       fragmenta version -> display version
       fragmenta help -> display help
-      fragmenta new [app|cms|URL of go gettable project] path/to/app -> creates a new app from the repository at URL at the path supplied
+      fragmenta new [app|cms|URL of go gettable project] path/to/app [--adapter postgres|mysql|sqlite3] -> creates a new app from the repository at URL at the path supplied
       fragmenta -> builds and runs a fragmenta app
       fragmenta server -> builds and runs a fragmenta app
+      fragmenta server --watch -> builds and runs a fragmenta app, rebuilding and restarting it when src or server.go change
       fragmenta test  -> run tests
       fragmenta migrate -> runs new sql migrations in db/migrate
-      fragmenta backup [development|production|test] -> backup the database to db/backup
-      fragmenta restore [development|production|test] -> backup the database from latest file in db/backup
+      fragmenta migrate [development|production|test] --to [version] -> migrates up or down to the version (a timestamp prefix is enough)
+      fragmenta migrate [development|production|test] --dry-run [--plan file.sql] -> prints the sql migrate would run, optionally writing it to a file
+      fragmenta migrate down [n] [development|production|test] [--to version] -> reverts the last n migrations (default 1) or back to version
+      fragmenta migrate redo [development|production|test] -> reverts the last migration and runs it again
+      fragmenta migrate status [development|production|test] -> lists applied, pending and orphaned migrations
+      fragmenta migrate verify [development|production|test] -> lists applied migrations which have changed on disk
+      fragmenta migrate squash --before [version] [development|production|test] [--dry-run] -> replaces the migrations before version with a baseline of their schema, dumped from a scratch database
+      fragmenta backup [development|production|test] -> backup the database to db/backup or the backup_store, then prune old backups
+      fragmenta backup [development|production|test] --sanitize -> backup the database with data masked by db/mask.json, for sharing
+      fragmenta backup [development|production|test] --tables users,pages -> backup only the tables given
+      fragmenta backup prune [development|production|test] [--dry-run] -> deletes backups in the store not kept by the retention settings
+      fragmenta backup list [development|production|test] -> lists the time, database and size of each backup in the store
+      fragmenta backup verify [development|production|test|file] -> checks the backup file, or every backup in the store, against its manifest
+      fragmenta restore [development|production|test] [--file path] [--at time] [--tables users,pages] -> restore the database, or only the tables given, from the latest backup in the store, or the file or time given
       fragmenta deploy [development|production|test] -> build and deploy using bin/deploy
       fragmenta generate resource [name] [fieldname]:[fieldtype]* -> creates resource CRUD actions and views
+      fragmenta db schema [development|production|test] -> writes the schema of the database to db/schema.sql
+      fragmenta db schema [development|production|test] --check -> exits non-zero if migrations are pending or db/schema.sql does not match the database
+      fragmenta db create [development|production|test] [--migrate] [--seed] -> creates the database and its user, then optionally migrates and seeds it
+      fragmenta db drop [development|production|test] -> drops the database, and its user if no other mode uses it
+      fragmenta db reset [development|production|test] -> drops, creates, migrates and seeds the database (production requires --force)
+      fragmenta db seed [development|production|test] -> loads the sql, csv and json seed files in db/seeds/[mode]
+      fragmenta db console [development|production|test] -> opens an interactive sql shell on the database
       fragmenta generate migration [name] -> creates a new named sql migration in db/migrate
+      fragmenta generate migration --go [name] -> creates a new named go migration in db/migrate
     ------
 
 
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/fragmenta/query"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// sqliteObject is a table, index, view or trigger read from sqlite_master
+type sqliteObject struct {
+	kind  string
+	name  string
+	table string
+	sql   string
+}
+
+// dumpSQLite writes the schema and data of the open sqlite database to w as sql,
+// with one insert statement per row. If tables are given, only those tables
+// and the indexes and triggers on them are written.
+func dumpSQLite(w io.Writer, tables []string) error {
+	// Read all objects before querying data, as we use just one connection
+	objects, err := readSQLiteObjects()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "-- Fragmenta %s sqlite dump\nPRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n", fragmentaVersion)
+
+	for _, o := range objects {
+		if len(tables) > 0 && !contains(o.table, tables) {
+			continue
+		}
+
+		if o.kind == "table" {
+			fmt.Fprintf(w, "DROP TABLE IF EXISTS %s;\n", quoteIdentifier(o.name))
+		}
+		fmt.Fprintf(w, "%s;\n", o.sql)
+
+		if o.kind == "table" {
+			err = dumpTableRows(w, o.name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "COMMIT;\n")
+	return nil
+}
+
+// readSQLiteObjects reads the schema objects in the open sqlite database,
+// tables first so that indexes, views and triggers can refer to them
+func readSQLiteObjects() ([]sqliteObject, error) {
+	sql := `SELECT type, name, tbl_name, sql FROM sqlite_master
+WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+ORDER BY CASE type WHEN 'table' THEN 0 ELSE 1 END, name;`
+
+	rows, err := query.QuerySQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []sqliteObject
+	for rows.Next() {
+		var o sqliteObject
+		err = rows.Scan(&o.kind, &o.name, &o.table, &o.sql)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+
+	return objects, rows.Err()
+}
+
+// dumpTableRows writes an insert statement for each row in table to w
+func dumpTableRows(w io.Writer, table string) error {
+	rows, err := query.QuerySQL(fmt.Sprintf("SELECT * FROM %s;", quoteIdentifier(table)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	quotedCols := make([]string, len(cols))
+	for i, c := range cols {
+		quotedCols[i] = quoteIdentifier(c)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", quoteIdentifier(table), strings.Join(quotedCols, ","))
+
+	values := make([]interface{}, len(cols))
+	pointers := make([]interface{}, len(cols))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return err
+		}
+
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literals[i] = sqlLiteral(v)
+		}
+
+		_, err = fmt.Fprintf(w, "%s(%s);\n", insert, strings.Join(literals, ","))
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// sqlLiteral formats a value scanned from the database as an sql literal
+func sqlLiteral(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case bool:
+		if value {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		return quoteSQL(value.Format("2006-01-02 15:04:05.999999999-07:00"))
+	case []byte:
+		// Drivers may return text as bytes, so only write binary data as a blob
+		if utf8.Valid(value) && bytes.IndexByte(value, 0) == -1 {
+			return quoteText(string(value))
+		}
+		return "X'" + hex.EncodeToString(value) + "'"
+	case string:
+		return quoteText(value)
+	default:
+		return quoteSQL(fmt.Sprintf("%v", value))
+	}
+}
+
+// quoteText quotes s as an sql string literal, writing line breaks as char(10) and char(13)
+// joined to the rest with ||, so that each statement in a dump is on one line
+func quoteText(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return quoteSQL(s)
+	}
+
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\n' && s[i] != '\r' {
+			continue
+		}
+		if i > start {
+			parts = append(parts, quoteSQL(s[start:i]))
+		}
+		parts = append(parts, fmt.Sprintf("char(%d)", s[i]))
+		start = i + 1
+	}
+	if start < len(s) {
+		parts = append(parts, quoteSQL(s[start:]))
+	}
+	return strings.Join(parts, "||")
+}
+
+// unquoteText returns the value of a string literal written by quoteText,
+// or false if literal is not a string
+func unquoteText(literal string) (string, bool) {
+	value := ""
+	for i := 0; i < len(literal); {
+		switch {
+		case literal[i] == '\'':
+			end := closingQuote(literal, i, false)
+			if end == -1 {
+				return "", false
+			}
+			value += strings.Replace(literal[i+1:end], "''", "'", -1)
+			i = end + 1
+		case strings.HasPrefix(literal[i:], "char("):
+			end := strings.IndexByte(literal[i:], ')')
+			if end == -1 {
+				return "", false
+			}
+			c, err := strconv.Atoi(literal[i+len("char(") : i+end])
+			if err != nil {
+				return "", false
+			}
+			value += string(rune(c))
+			i += end + 1
+		default:
+			return "", false
+		}
+
+		// Parts are joined with ||
+		if i < len(literal) {
+			if !strings.HasPrefix(literal[i:], "||") {
+				return "", false
+			}
+			i += 2
+		}
+	}
+	return value, literal != ""
+}
+
+// quoteIdentifier quotes a table or column name
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -82,7 +83,12 @@ func main() {
 
 	case "server", "s":
 		if requireValidProject(projectPath) {
-			RunServer(projectPath)
+			_, flags := parseArgs(args[2:], "watch")
+			if flags["watch"] == "true" {
+				RunWatchServer(projectPath)
+			} else {
+				RunServer(projectPath)
+			}
 		}
 
 	case "test", "t":
@@ -108,6 +114,11 @@ func main() {
 			RunMigrate(args)
 		}
 
+	case "db":
+		if requireValidProject(projectPath) {
+			RunDB(args)
+		}
+
 	case "backup", "b":
 		if requireValidProject(projectPath) {
 			RunBackup(args)
@@ -149,16 +160,37 @@ func ShowHelp(args []string) {
 	helpString += fmt.Sprintf("Fragmenta version: %s", fragmentaVersion)
 	helpString += "\n  fragmenta version -> display version"
 	helpString += "\n  fragmenta help -> display help"
-	helpString += "\n  fragmenta new [app|cms|URL] path/to/app -> creates a new app from the repository at URL at the path supplied"
+	helpString += "\n  fragmenta new [app|cms|URL] path/to/app [--adapter postgres|mysql|sqlite3] -> creates a new app from the repository at URL at the path supplied"
 	helpString += "\n  fragmenta -> builds and runs a fragmenta app"
 	helpString += "\n  fragmenta server -> builds and runs a fragmenta app"
+	helpString += "\n  fragmenta server --watch -> builds and runs a fragmenta app, rebuilding and restarting it when src or server.go change"
 	helpString += "\n  fragmenta test  -> run tests"
 	helpString += "\n  fragmenta migrate -> runs new sql migrations in db/migrate"
-	helpString += "\n  fragmenta backup [development|production|test] -> backup the database to db/backup"
-	helpString += "\n  fragmenta restore [development|production|test] -> backup the database from latest file in db/backup"
+	helpString += "\n  fragmenta migrate [development|production|test] --to [version] -> migrates up or down to the version (a timestamp prefix is enough)"
+	helpString += "\n  fragmenta migrate [development|production|test] --dry-run [--plan file.sql] -> prints the sql migrate would run, optionally writing it to a file"
+	helpString += "\n  fragmenta migrate down [n] [development|production|test] [--to version] -> reverts the last n migrations (default 1) or back to version"
+	helpString += "\n  fragmenta migrate redo [development|production|test] -> reverts the last migration and runs it again"
+	helpString += "\n  fragmenta migrate status [development|production|test] -> lists applied, pending and orphaned migrations"
+	helpString += "\n  fragmenta migrate verify [development|production|test] -> lists applied migrations which have changed on disk"
+	helpString += "\n  fragmenta migrate squash --before [version] [development|production|test] [--dry-run] -> replaces the migrations before version with a baseline of their schema, dumped from a scratch database"
+	helpString += "\n  fragmenta backup [development|production|test] -> backup the database to db/backup or the backup_store, then prune old backups"
+	helpString += "\n  fragmenta backup [development|production|test] --sanitize -> backup the database with data masked by db/mask.json, for sharing"
+	helpString += "\n  fragmenta backup [development|production|test] --tables users,pages -> backup only the tables given"
+	helpString += "\n  fragmenta backup prune [development|production|test] [--dry-run] -> deletes backups in the store not kept by the retention settings"
+	helpString += "\n  fragmenta backup list [development|production|test] -> lists the time, database and size of each backup in the store"
+	helpString += "\n  fragmenta backup verify [development|production|test|file] -> checks the backup file, or every backup in the store, against its manifest"
+	helpString += "\n  fragmenta restore [development|production|test] [--file path] [--at time] [--tables users,pages] -> restore the database, or only the tables given, from the latest backup in the store, or the file or time given"
 	helpString += "\n  fragmenta deploy [development|production|test] -> build and deploy using bin/deploy"
 	helpString += "\n  fragmenta generate resource [name] [fieldname]:[fieldtype]* -> creates resource CRUD actions and views"
+	helpString += "\n  fragmenta db schema [development|production|test] -> writes the schema of the database to db/schema.sql"
+	helpString += "\n  fragmenta db schema [development|production|test] --check -> exits non-zero if migrations are pending or db/schema.sql does not match the database"
+	helpString += "\n  fragmenta db create [development|production|test] [--migrate] [--seed] -> creates the database and its user, then optionally migrates and seeds it"
+	helpString += "\n  fragmenta db drop [development|production|test] -> drops the database, and its user if no other mode uses it"
+	helpString += "\n  fragmenta db reset [development|production|test] -> drops, creates, migrates and seeds the database (production requires --force)"
+	helpString += "\n  fragmenta db seed [development|production|test] -> loads the sql, csv and json seed files in db/seeds/[mode]"
+	helpString += "\n  fragmenta db console [development|production|test] -> opens an interactive sql shell on the database"
 	helpString += "\n  fragmenta generate migration [name] -> creates a new named sql migration in db/migrate"
+	helpString += "\n  fragmenta generate migration --go [name] -> creates a new named go migration in db/migrate"
 
 	helpString += fragmentaDivider
 	log.Print(helpString)
@@ -227,6 +259,16 @@ func dbMigratePath(projectPath string) string {
 	return filepath.Join(projectPath, "db", "migrate")
 }
 
+// dbSchemaPath returns the path of the schema dump written after migrations
+func dbSchemaPath(projectPath string) string {
+	return filepath.Join(projectPath, "db", "schema.sql")
+}
+
+// dbSeedsPath returns the path of the seed folders for each mode
+func dbSeedsPath(projectPath string) string {
+	return filepath.Join(projectPath, "db", "seeds")
+}
+
 // dbBackupPath returns a path to store database backups
 func dbBackupPath(projectPath string) string {
 	return filepath.Join(projectPath, "db", "backup")
@@ -295,6 +337,51 @@ func runCommand(command string, args ...string) ([]byte, error) {
 	return output, nil
 }
 
+// runCommandInput runs a command with exec.Command, passing input to stdin
+func runCommandInput(input string, command string, args ...string) ([]byte, error) {
+
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = strings.NewReader(input)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, err
+	}
+
+	return output, nil
+}
+
+// runCommandEnv runs a command with exec.Command, with the environment given
+func runCommandEnv(env []string, command string, args ...string) ([]byte, error) {
+
+	cmd := exec.Command(command, args...)
+	cmd.Env = env
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, err
+	}
+
+	return output, nil
+}
+
+// runCommandStream runs a command with exec.Command, reading stdin from in and writing stdout to out,
+// with the environment given (or that of this process if env is nil).
+// It returns stderr, along with stdout if out is nil.
+func runCommandStream(env []string, in io.Reader, out io.Writer, command string, args ...string) ([]byte, error) {
+
+	var output bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Env = env
+	cmd.Stdin = in
+	cmd.Stdout = &output
+	if out != nil {
+		cmd.Stdout = out
+	}
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	return output.Bytes(), err
+}
+
 // requireValidProject returns true if we have a valid project at projectPath
 func requireValidProject(projectPath string) bool {
 	if isValidProject(projectPath) {
@@ -327,6 +414,55 @@ func fileExists(p string) bool {
 	return true
 }
 
+// parseArgs splits args into positional arguments and flags,
+// flags may be given as --name value or --name=value, flags listed in boolFlags take no value
+func parseArgs(args []string, boolFlags ...string) ([]string, map[string]string) {
+	var positional []string
+	flags := make(map[string]string)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name := strings.TrimPrefix(arg, "--")
+		parts := strings.SplitN(name, "=", 2)
+		if len(parts) == 2 {
+			flags[parts[0]] = parts[1]
+			continue
+		}
+
+		if contains(name, boolFlags) || i+1 == len(args) {
+			flags[name] = "true"
+			continue
+		}
+
+		flags[name] = args[i+1]
+		i++
+	}
+
+	return positional, flags
+}
+
+// configForMode returns the config for this mode (development by default)
+func configForMode(mode string) map[string]string {
+	switch mode {
+	case ModeProduction:
+		return ConfigProduction
+	case ModeTest:
+		return ConfigTest
+	default:
+		return ConfigDevelopment
+	}
+}
+
+// isMode returns true if s is the name of a mode
+func isMode(s string) bool {
+	return s == ModeDevelopment || s == ModeProduction || s == ModeTest
+}
+
 // readConfig reads our config file and set up the server accordingly
 func readConfig(projectPath string) error {
 	configPath := configPath(projectPath)
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestParseArgs tests splitting args into positional arguments and flags
+func TestParseArgs(t *testing.T) {
+	args := []string{"down", "--to", "2016-01-02", "production", "--dry-run", "--file=plan.sql"}
+	positional, flags := parseArgs(args, "dry-run")
+
+	if len(positional) != 2 || positional[0] != "down" || positional[1] != "production" {
+		t.Fatalf("Failed to parse positional args result:%v", positional)
+	}
+
+	if flags["to"] != "2016-01-02" || flags["dry-run"] != "true" || flags["file"] != "plan.sql" {
+		t.Fatalf("Failed to parse flags result:%v", flags)
+	}
+}
+
+// TestRunCommandStream tests streaming input and output through a command
+func TestRunCommandStream(t *testing.T) {
+	var out bytes.Buffer
+	result, err := runCommandStream(nil, strings.NewReader("SELECT 1;\n"), &out, "cat")
+	if err != nil || out.String() != "SELECT 1;\n" || len(result) != 0 {
+		t.Fatalf("Failed to stream through command result:%q %q %s", out.String(), result, err)
+	}
+
+	result, err = runCommandStream(nil, nil, nil, "sh", "-c", "echo out; echo err >&2; exit 1")
+	if err == nil || !strings.Contains(string(result), "out") || !strings.Contains(string(result), "err") {
+		t.Fatalf("Failed to capture command output result:%q %s", result, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -46,9 +47,19 @@ func RunGenerate(args []string) {
 	args = args[1:]
 	switch command {
 	case "migration":
+		args, flags := parseArgs(args, "go")
+		if len(args) == 0 {
+			fmt.Println("Error - no name for migration")
+			return
+		}
 		name := args[0]
+		if flags["go"] != "" {
+			generateGoMigration(name)
+			return
+		}
 		sql := fmt.Sprintf("/* SQL migration %s */", name)
-		generateMigration(name, sql)
+		downSQL := fmt.Sprintf("/* SQL to revert migration %s */", name)
+		generateMigration(name, sql, downSQL)
 	case "resource":
 		generateResource(args)
 	case "join":
@@ -59,7 +70,8 @@ func RunGenerate(args []string) {
 		sort.Strings(args)
 		name := fmt.Sprintf("%s-%s", args[0], args[1])
 		sql := generateJoinSQL(args)
-		generateMigration(name, sql)
+		downSQL := generateJoinDownSQL(args)
+		generateMigration(name, sql, downSQL)
 	default:
 		fmt.Println("Sorry, I didn't recognise that argument, you can use fragmenta generate [migration|resource|join]")
 	}
@@ -103,9 +115,11 @@ func generateResource(args []string) {
 	fmt.Printf("Generating resource with\n - name:%s\n - attributes:%v\n", resourceName, columns)
 
 	joinSQL := ""
+	joinDownSQL := ""
 	if len(joins) > 0 {
 		for _, j := range joins {
 			joinSQL += generateJoinSQL([]string{resourceName, j})
+			joinDownSQL += generateJoinDownSQL([]string{resourceName, j})
 		}
 	}
 
@@ -117,7 +131,10 @@ func generateResource(args []string) {
 	}
 
 	// Then db migration
-	generateResourceMigration(joinSQL)
+	generateResourceMigration(joinSQL, joinDownSQL)
+
+	// Then a sample seed for development
+	generateResourceSeed()
 
 	// Then generate routes
 	generateResourceRoutes()
@@ -189,25 +206,44 @@ CREATE TABLE [[.join_table]] (
 `
 
 	context := map[string]string{
-		"join_table": ToPlural(a) + "_" + ToPlural(b), // e.g. places_tags
-		"a":          a,                               // places
-		"b":          b,                               // tags
+		"join_table": joinTableName(args), // e.g. places_tags
+		"a":          a,                   // places
+		"b":          b,                   // tags
 	}
 
 	return renderTemplate(sql, context)
 
 }
 
+// Generate SQL to revert a join table migration
+func generateJoinDownSQL(args []string) string {
+
+	if len(args) < 2 {
+		return ""
+	}
+
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s;\n", joinTableName(args))
+}
+
+// joinTableName returns the name of the join table for two resources e.g. places_tags
+func joinTableName(args []string) string {
+	names := []string{args[0], args[1]}
+	sort.Strings(names)
+	return ToPlural(names[0]) + "_" + ToPlural(names[1])
+}
+
 // Generate a migration to create this resource table
-func generateResourceMigration(joinsSQL string) {
+func generateResourceMigration(joinsSQL string, joinsDownSQL string) {
+
+	d := dialectFor(ConfigDevelopment)
 
 	// We add the following fields to all resourceNames
 	sql := `DROP TABLE IF EXISTS [[.fragmenta_resources]];
 CREATE TABLE [[.fragmenta_resources]] (
-id SERIAL NOT NULL,
-created_at timestamp,
-updated_at timestamp,
 `
+	sql += d.PrimaryKeySQL() + ",\n"
+	sql += fmt.Sprintf("created_at %s,\n", toSQLType("timestamp"))
+	sql += fmt.Sprintf("updated_at %s,\n", toSQLType("timestamp"))
 
 	for k, v := range columns {
 		sql = sql + fmt.Sprintf("%s %s,\n", k, toSQLType(v))
@@ -216,15 +252,72 @@ updated_at timestamp,
 	sql = sql + ");\n"
 	sql = strings.Replace(sql, ",\n)", "\n)", -1)
 
-	sql += "ALTER TABLE [[.fragmenta_resources]] OWNER TO [[.fragmenta_db_user]];\n"
+	sql += d.OwnerSQL("[[.fragmenta_resources]]", "[[.fragmenta_db_user]]")
 
 	sql = reifyString(sql)
 
 	sql += joinsSQL
 
+	// Revert by dropping the joins and then the resource table
+	downSQL := joinsDownSQL + reifyString("DROP TABLE IF EXISTS [[.fragmenta_resources]];\n")
+
 	name := fmt.Sprintf("Create-%s", ToCamel(resourceName))
-	generateMigration(name, sql)
+	generateMigration(name, sql, downSQL)
+
+}
+
+// Generate a sample json seed file for this resource in db/seeds/development
+func generateResourceSeed() {
+	table := reifyString("[[.fragmenta_resources]]")
+	path := filepath.Join(dbSeedsPath("."), ModeDevelopment, table+".json")
+	if fileExists(path) {
+		fmt.Println("Seed file already exists at: ", path)
+		return
+	}
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+	row := map[string]interface{}{
+		"id":         1,
+		"created_at": now,
+		"updated_at": now,
+	}
+	for k, v := range columns {
+		row[k] = seedValue(k, v)
+	}
+
+	seed := seedJSON{Table: table, Key: seedDefaultKey, Rows: []map[string]interface{}{row}}
+	data, err := json.MarshalIndent(seed, "", "\t")
+	if err != nil {
+		fmt.Println("Error generating seed: ", err)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(path, append(data, '\n'), permissions)
+	}
+	if err != nil {
+		fmt.Println("Error writing seed file: ", path)
+		return
+	}
 
+	fmt.Println("Generated seed at: ", path)
+}
+
+// seedValue returns a sample value for a column of a user-defined type
+func seedValue(name string, fieldType string) interface{} {
+	switch fieldType {
+	case "int", "int64", "integer", "bigint":
+		return 1
+	case "float", "double":
+		return 1.5
+	case "bool", "boolean":
+		return true
+	case "timestamp", "time", "datetime", "date":
+		return time.Now().UTC().Format("2006-01-02 15:04:05")
+	default:
+		return fmt.Sprintf("Example %s", name)
+	}
 }
 
 // Return the path of the routes.go file
@@ -570,23 +663,9 @@ func toGoType(fieldType string) string {
 }
 
 // Convert a user-defined type to an sql type
-// this may vary with the database
+// this varies with the database adapter set in the development config
 func toSQLType(fieldType string) string {
-	switch fieldType {
-	case "text", "string", "char(255)":
-		return "text"
-	case "int", "int64", "integer", "bigint":
-		return "integer"
-	case "timestamp", "time", "datetime", "date":
-		return "timestamp"
-	case "float":
-		return "real"
-	case "double":
-		return "double precision"
-	default:
-		return fieldType
-	}
-
+	return dialectFor(ConfigDevelopment).SQLType(fieldType)
 }
 
 // Convert a user-defined type to an input type
@@ -615,8 +694,9 @@ func sortedKeys(m map[string]string) []string {
 
 // ------------------------- MIGRATIONS  --------------
 
-// Generate a migration file in db/migrate
-func generateMigration(name string, content string) {
+// Generate a migration file in db/migrate,
+// along with a paired down migration file if downContent is not empty
+func generateMigration(name string, content string, downContent string) {
 	path := migrationPath(".", name)
 
 	fmt.Println("Generating migration: ", name)
@@ -629,6 +709,36 @@ func generateMigration(name string, content string) {
 
 	fmt.Println("Generated migration at: ", path)
 
+	if len(downContent) == 0 {
+		return
+	}
+
+	downPath := strings.TrimSuffix(path, ".sql") + migrationDownSuffix
+	err = ioutil.WriteFile(downPath, []byte(downContent), 0744)
+	if err != nil {
+		fmt.Println("Error writing down migration file: ", downPath)
+		return
+	}
+
+	fmt.Println("Generated down migration at: ", downPath)
+
+}
+
+// Generate a Go migration file in db/migrate, registered with the file name as id
+func generateGoMigration(name string) {
+	path := strings.TrimSuffix(migrationPath(".", name), ".sql") + ".go"
+
+	fmt.Println("Generating go migration: ", name)
+
+	id := strings.TrimSuffix(filepath.Base(path), ".go")
+	content := renderTemplate(goMigrationTemplate, map[string]string{"id": id})
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		fmt.Println("Error writing go migration file: ", path)
+		return
+	}
+
+	fmt.Println("Generated go migration at: ", path)
 }
 
 // Generate a suitable path for a migration from the current date/time down to nanosecond
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// The build tag for Go migrations, so that they are not built with the app
+	goMigrationTag = "fragmenta_migration"
+
+	// The runner file written alongside Go migrations while they are run
+	goMigrationRunnerName = "fragmenta_migration_runner.go"
+)
+
+// goMigrationName matches the names of Go migrations, which start with a timestamp like sql migrations.
+// Other Go files in db/migrate are helpers, which are built with each Go migration.
+var goMigrationName = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}-\d{6}-.+\.go$`)
+
+// goMigrationFiles returns the paths of the Go migrations in dir
+func goMigrationFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []string
+	for _, f := range files {
+		name := filepath.Base(f)
+		if goMigrationName.MatchString(name) && !strings.HasSuffix(name, "_test.go") {
+			migrations = append(migrations, f)
+		}
+	}
+	return migrations, nil
+}
+
+// goMigrationHelpers returns the paths of the Go files in dir which are not migrations or tests,
+// so that migrations can share code
+func goMigrationHelpers(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	var helpers []string
+	for _, f := range files {
+		name := filepath.Base(f)
+		if goMigrationName.MatchString(name) || strings.HasSuffix(name, "_test.go") || name == goMigrationRunnerName {
+			continue
+		}
+		helpers = append(helpers, f)
+	}
+	return helpers, nil
+}
+
+// goMigrationID returns the id a Go migration registers with, the file name without extension
+func goMigrationID(m *migration) string {
+	return strings.TrimSuffix(m.name, ".go")
+}
+
+// runGoMigration compiles and runs the Go migration m in direction with go run,
+// along with any helper files beside it and a runner which opens the database, then calls
+// the registered function and executes the record statements (one per line on stdin) in one transaction.
+// Database credentials are passed in the environment rather than on the command line.
+func runGoMigration(config map[string]string, m *migration, direction string, record []string) error {
+	helpers, err := goMigrationHelpers(filepath.Dir(m.path))
+	if err != nil {
+		return fmt.Errorf("error reading migration helpers %s", err)
+	}
+
+	runner := filepath.Join(filepath.Dir(m.path), goMigrationRunnerName)
+	err = ioutil.WriteFile(runner, []byte(goMigrationRunner), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing migration runner %s", err)
+	}
+	defer os.Remove(runner)
+
+	args := []string{"run", "-tags", goMigrationTag, m.path}
+	args = append(args, helpers...)
+	args = append(args, runner, goMigrationID(m), direction)
+
+	cmd := exec.Command("go", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(record, "\n"))
+	cmd.Env = append(os.Environ(),
+		"FRAGMENTA_DB_ADAPTER="+config["db_adapter"],
+		"FRAGMENTA_DB="+config["db"],
+		"FRAGMENTA_DB_USER="+config["db_user"],
+		"FRAGMENTA_DB_PASS="+config["db_pass"],
+	)
+
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		log.Printf("%s", string(output))
+	}
+	if err != nil {
+		return fmt.Errorf("error running go migration %s %s", m.name, err)
+	}
+
+	return nil
+}
+
+// goMigrationTemplate is the scaffold for a new Go migration
+var goMigrationTemplate = `//go:build fragmenta_migration
+// +build fragmenta_migration
+
+package main
+
+import (
+	"github.com/fragmenta/query"
+)
+
+// Go migration [[ .id ]]
+// The database is open, and up or down is run within a transaction
+// along with the update to fragmenta_metadata.
+
+func init() {
+	register("[[ .id ]]", up, down)
+}
+
+// up applies the migration
+func up() error {
+	_, err := query.ExecSQL("SELECT 1;")
+	return err
+}
+
+// down reverts the migration
+func down() error {
+	_, err := query.ExecSQL("SELECT 1;")
+	return err
+}
+`
+
+// goMigrationRunner is built with a Go migration to run it against the database
+var goMigrationRunner = `//go:build fragmenta_migration
+// +build fragmenta_migration
+
+// Code generated by fragmenta migrate. DO NOT EDIT.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/fragmenta/query"
+)
+
+var migrations = map[string][2]func() error{}
+
+// register is called by migrations to register their up and down functions
+func register(id string, up func() error, down func() error) {
+	migrations[id] = [2]func() error{up, down}
+}
+
+func main() {
+	err := run(os.Args[1], os.Args[2])
+	if err != nil {
+		fmt.Printf("Error running migration %s %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func run(id string, direction string) error {
+	fns, ok := migrations[id]
+	if !ok {
+		return fmt.Errorf("no migration registered with id %s", id)
+	}
+	fn := fns[0]
+	if direction == "down" {
+		fn = fns[1]
+	}
+
+	record, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	query.SetMaxOpenConns(1)
+	err = query.OpenDatabase(map[string]string{
+		"adapter":  os.Getenv("FRAGMENTA_DB_ADAPTER"),
+		"db":       os.Getenv("FRAGMENTA_DB"),
+		"user":     os.Getenv("FRAGMENTA_DB_USER"),
+		"password": os.Getenv("FRAGMENTA_DB_PASS"),
+	})
+	if err != nil {
+		return err
+	}
+	defer query.CloseDatabase()
+
+	_, err = query.ExecSQL("BEGIN;")
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	for _, sql := range strings.Split(string(record), "\n") {
+		if err != nil || strings.TrimSpace(sql) == "" {
+			continue
+		}
+		_, err = query.ExecSQL(sql)
+	}
+	if err != nil {
+		query.ExecSQL("ROLLBACK;")
+		return err
+	}
+
+	_, err = query.ExecSQL("COMMIT;")
+	return err
+}
+`
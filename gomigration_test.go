@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGoMigrationFiles tests separating Go migrations from helpers and tests in db/migrate
+func TestGoMigrationFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fragmenta-gomigration")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"2016-01-01-120000-Backfill-Pages.go",
+		"2016-01-02-120000-Backfill-Users.go",
+		"2016-01-02-120000-Backfill-Users_test.go",
+		"helpers.go",
+		"helpers_test.go",
+		goMigrationRunnerName,
+		"2016-01-01-110000-Create-Pages.sql",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("package main"), 0644)
+	}
+
+	names := func(paths []string) string {
+		var result []string
+		for _, p := range paths {
+			result = append(result, filepath.Base(p))
+		}
+		return strings.Join(result, ",")
+	}
+
+	migrations, err := goMigrationFiles(dir)
+	expected := "2016-01-01-120000-Backfill-Pages.go,2016-01-02-120000-Backfill-Users.go"
+	if err != nil || names(migrations) != expected {
+		t.Fatalf("Failed to find go migrations expected:%s result:%s %v", expected, names(migrations), err)
+	}
+
+	helpers, err := goMigrationHelpers(dir)
+	if err != nil || names(helpers) != "helpers.go" {
+		t.Fatalf("Failed to find go migration helpers result:%s %v", names(helpers), err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The port the live reload server listens on, unless livereload_port is set in config
+const liveReloadPort = "35729"
+
+// The messages sent to browsers by the live reload server
+const (
+	reloadPage = "page"
+	reloadCSS  = "css"
+)
+
+// liveReloadScript is served at /livereload.js for the development layout to include,
+// it reloads stylesheets in place or refreshes the page when told to
+const liveReloadScript = `(function() {
+  var source = new EventSource("//%s/livereload");
+  source.addEventListener("reload", function(e) {
+    if (e.data != "css") {
+      window.location.reload();
+      return;
+    }
+    var links = document.querySelectorAll("link[rel=stylesheet]");
+    for (var i = 0; i < links.length; i++) {
+      var href = links[i].href.replace(/[?&]livereload=\d+$/, "");
+      links[i].href = href + (href.indexOf("?") == -1 ? "?" : "&") + "livereload=" + Date.now();
+    }
+  });
+})();
+`
+
+// liveReload tells browsers connected with server-sent events to reload
+type liveReload struct {
+	mu      sync.Mutex
+	clients map[chan string]bool
+}
+
+// newLiveReload returns a live reload server with no clients
+func newLiveReload() *liveReload {
+	return &liveReload{clients: make(map[chan string]bool)}
+}
+
+// liveReloadAddress returns the local address for the live reload server from config
+func liveReloadAddress(config map[string]string) string {
+	port := config["livereload_port"]
+	if port == "" {
+		port = liveReloadPort
+	}
+	return "localhost:" + port
+}
+
+// listen serves live reload at address in the background, logging any error,
+// as the server can run without it
+func (l *liveReload) listen(address string) {
+	go func() {
+		log.Printf("Live reload at http://%s/livereload.js", address)
+		err := http.ListenAndServe(address, l)
+		if err != nil {
+			log.Printf("Error serving live reload %s", err)
+		}
+	}()
+}
+
+// ServeHTTP serves the script at /livereload.js and the event stream at /livereload
+func (l *liveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/livereload.js":
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprintf(w, liveReloadScript, r.Host)
+	case "/livereload":
+		l.serveEvents(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveEvents streams a reload event to the browser each time notify is called,
+// until the browser disconnects
+func (l *liveReload) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The page is served from the app on another port
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Ask browsers to reconnect quickly if we restart
+	fmt.Fprintf(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	events := make(chan string, 1)
+	l.mu.Lock()
+	l.clients[events] = true
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.clients, events)
+		l.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case message := <-events:
+			fmt.Fprintf(w, "event: reload\ndata: %s\n\n", message)
+			flusher.Flush()
+		}
+	}
+}
+
+// notify tells connected browsers to reload the page, or just the stylesheets if message is reloadCSS
+func (l *liveReload) notify(message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for events := range l.clients {
+		// Skip browsers which have not read the last message, as they will reload anyway
+		select {
+		case events <- message:
+		default:
+		}
+	}
+}
+
+// The kinds of change to watched files
+const (
+	changeCode     = "code"
+	changeTemplate = "template"
+	changeAsset    = "asset"
+)
+
+// changeKind returns whether the file at path is an asset (below an assets folder),
+// a view template, or code which requires the server to be rebuilt
+func changeKind(path string) string {
+	if strings.Contains(filepath.ToSlash(path), "/assets/") {
+		return changeAsset
+	}
+	if filepath.Ext(path) == ".got" {
+		return changeTemplate
+	}
+	return changeCode
+}
+
+// reloadFor returns the reload needed for changed files which do not need a rebuild,
+// stylesheets are reloaded in place if only they have changed
+func reloadFor(changed []string) string {
+	for _, path := range changed {
+		if changeKind(path) != changeAsset || filepath.Ext(path) != ".css" {
+			return reloadPage
+		}
+	}
+	return reloadCSS
+}
+
+// waitForServer waits up to timeout for the server to accept connections at address
+func waitForServer(address string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", address, 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
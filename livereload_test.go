@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReloadFor tests choosing how browsers reload for changed files
+func TestReloadFor(t *testing.T) {
+	css := filepath.Join("src", "app", "assets", "styles", "app.css")
+	js := filepath.Join("src", "app", "assets", "scripts", "app.js")
+	view := filepath.Join("src", "pages", "views", "show.html.got")
+	code := filepath.Join("src", "pages", "actions", "show.go")
+
+	tests := []struct {
+		changed []string
+		kind    string
+		reload  string
+	}{
+		{[]string{css}, changeAsset, reloadCSS},
+		{[]string{js}, changeAsset, reloadPage},
+		{[]string{view}, changeTemplate, reloadPage},
+		{[]string{css, view}, changeAsset, reloadPage},
+		{[]string{code}, changeCode, reloadPage},
+	}
+
+	for _, test := range tests {
+		if kind := changeKind(test.changed[0]); kind != test.kind {
+			t.Fatalf("Failed to classify change %s expected:%s result:%s", test.changed[0], test.kind, kind)
+		}
+		if reload := reloadFor(test.changed); reload != test.reload {
+			t.Fatalf("Failed to choose reload for %v expected:%s result:%s", test.changed, test.reload, reload)
+		}
+	}
+}
+
+// TestScanAssets tests that all files in assets folders are watched
+func TestScanAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fragmenta-livereload")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	styles := filepath.Join(dir, "src", "app", "assets", "styles")
+	images := filepath.Join(dir, "src", "app", "assets", "images")
+	os.MkdirAll(styles, os.ModePerm)
+	os.MkdirAll(images, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(styles, "app.css"), []byte("body {}"), 0644)
+	ioutil.WriteFile(filepath.Join(images, "logo.svg"), []byte("<svg>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "src", "app", "notes.txt"), []byte("notes"), 0644)
+
+	files, err := scanFiles([]string{filepath.Join(dir, "src")})
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Failed to scan assets %v %s", files, err)
+	}
+}
+
+// TestLiveReload tests sending reload events to a connected browser
+func TestLiveReload(t *testing.T) {
+	reload := newLiveReload()
+	server := httptest.NewServer(reload)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/livereload.js")
+	if err != nil {
+		t.Fatalf("Failed to get script %s", err)
+	}
+	script, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	if !strings.Contains(string(script), `new EventSource("//`+host+`/livereload")`) {
+		t.Fatalf("Failed to serve script for host %s:\n%s", host, script)
+	}
+
+	resp, err = http.Get(server.URL + "/livereload")
+	if err != nil {
+		t.Fatalf("Failed to connect to events %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Failed to serve events, content type:%s", resp.Header.Get("Content-Type"))
+	}
+
+	// Read up to the end of the retry message, so we know the client is registered
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read events %s", err)
+		}
+		if line == "\n" {
+			break
+		}
+	}
+
+	reload.notify(reloadCSS)
+
+	events := make(chan string, 1)
+	go func() {
+		event := ""
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\n" {
+				break
+			}
+			event += line
+		}
+		events <- event
+	}()
+
+	select {
+	case event := <-events:
+		if event != "event: reload\ndata: css\n" {
+			t.Fatalf("Failed to send reload event, result:%q", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed to receive reload event")
+	}
+}
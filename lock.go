@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/fragmenta/query"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// The key used for the postgres advisory lock held while migrating ("fragment" in ascii)
+	migrateLockKey = int64(0x667261676d656e74)
+
+	// The name of the lock row used for other databases
+	migrateLockName = "migrate"
+
+	// The default time to wait for another migration to finish, in seconds
+	migrateLockTimeout = 60
+)
+
+// The sql for the lock row used for databases other than postgres,
+// a second insert of the row fails until it is deleted
+const (
+	lockTableSQL     = "CREATE TABLE IF NOT EXISTS fragmenta_locks (name varchar(255) PRIMARY KEY, holder text, locked_at text);"
+	lockRowSQL       = "INSERT INTO fragmenta_locks(name,holder,locked_at) VALUES(?,?,?);"
+	lockRowHolderSQL = "SELECT holder, locked_at FROM fragmenta_locks WHERE name=?;"
+	unlockRowSQL     = "DELETE FROM fragmenta_locks WHERE name=? AND holder=?;"
+)
+
+// lockHolder returns a description of this process, used to identify who holds a lock
+func lockHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("fragmenta migrate %s:%d", host, os.Getpid())
+}
+
+// lockTimeout returns the time to wait for the migration lock,
+// set with migrate_lock_timeout (in seconds) in the config
+func lockTimeout(config map[string]string) time.Duration {
+	seconds, err := strconv.Atoi(config["migrate_lock_timeout"])
+	if err != nil {
+		seconds = migrateLockTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// lockMigrations waits until it can take the migration lock on the open database,
+// so that concurrent migrations cannot interleave.
+// Postgres uses an advisory lock, other databases a row in fragmenta_locks.
+// If it returns without error, call unlockMigrations when finished.
+func lockMigrations(config map[string]string) error {
+	timeout := lockTimeout(config)
+	deadline := time.Now().Add(timeout)
+	postgres := isPostgres(config)
+
+	if postgres {
+		// Name our connection so that other runs can report who holds the lock
+		_, err := query.ExecSQL("SELECT set_config('application_name', $1, false);", lockHolder())
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := query.ExecSQL(lockTableSQL)
+		if err != nil {
+			return err
+		}
+	}
+
+	waiting := false
+	for {
+		var locked bool
+		var err error
+		if postgres {
+			locked, err = tryAdvisoryLock()
+		} else {
+			locked, err = tryLockRow()
+		}
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+
+		holder := migrationLockHolder(postgres)
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gave up waiting %s for migration lock on db %s held by %s", timeout, config["db"], holder)
+		}
+
+		if !waiting {
+			log.Printf("Waiting for migration lock on db %s held by %s", config["db"], holder)
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// unlockMigrations releases the lock taken by lockMigrations
+func unlockMigrations(config map[string]string) {
+	var err error
+	if isPostgres(config) {
+		_, err = query.ExecSQL("SELECT pg_advisory_unlock($1);", migrateLockKey)
+	} else {
+		_, err = query.ExecSQL(unlockRowSQL, migrateLockName, lockHolder())
+	}
+	if err != nil {
+		log.Printf("Database ERROR releasing migration lock %s", err)
+	}
+}
+
+// tryAdvisoryLock attempts to take the postgres advisory lock without waiting
+func tryAdvisoryLock() (bool, error) {
+	rows, err := query.QuerySQL("SELECT pg_try_advisory_lock($1);", migrateLockKey)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	locked := false
+	if rows.Next() {
+		err = rows.Scan(&locked)
+	}
+	return locked, err
+}
+
+// tryLockRow attempts to insert the lock row without waiting,
+// failing to insert means another process holds the lock
+func tryLockRow() (bool, error) {
+	_, err := query.ExecSQL(lockRowSQL, migrateLockName, lockHolder(), time.Now().UTC().Format(time.RFC3339))
+	if err == nil {
+		return true, nil
+	}
+
+	// If there is no lock row, the insert failed for another reason
+	if migrationLockHolder(false) == "unknown" {
+		return false, err
+	}
+	return false, nil
+}
+
+// migrationLockHolder describes the process holding the migration lock
+func migrationLockHolder(postgres bool) string {
+	var rows *sql.Rows
+	var err error
+
+	if postgres {
+		sql := `SELECT a.pid, COALESCE(a.application_name,''), COALESCE(a.usename,''), COALESCE(host(a.client_addr),'local'), a.backend_start 
+FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid 
+WHERE l.locktype = 'advisory' AND l.granted AND l.classid = $1 AND l.objid = $2 AND l.objsubid = 1;`
+		classid, objid := advisoryLockKeys()
+		rows, err = query.QuerySQL(sql, classid, objid)
+	} else {
+		rows, err = query.QuerySQL(lockRowHolderSQL, migrateLockName)
+	}
+	if err != nil {
+		return "unknown"
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return "unknown"
+	}
+
+	if postgres {
+		var pid int64
+		var app, user, client string
+		var started time.Time
+		err = rows.Scan(&pid, &app, &user, &client, &started)
+		if err != nil {
+			return "unknown"
+		}
+		return fmt.Sprintf("%s (pid %d, user %s, client %s, connected %s)", app, pid, user, client, started.Format(time.RFC3339))
+	}
+
+	var holder, lockedAt string
+	err = rows.Scan(&holder, &lockedAt)
+	if err != nil {
+		return "unknown"
+	}
+	return rowLockHolder(holder, lockedAt)
+}
+
+// advisoryLockKeys returns the classid (high bits) and objid (low bits)
+// which pg_locks shows for the advisory lock on migrateLockKey
+func advisoryLockKeys() (int64, int64) {
+	return migrateLockKey >> 32, migrateLockKey & 0xffffffff
+}
+
+// rowLockHolder describes the holder of the lock row in fragmenta_locks
+func rowLockHolder(holder, lockedAt string) string {
+	return fmt.Sprintf("%s (locked at %s, delete the row in fragmenta_locks if this process has died)", holder, lockedAt)
+}
+
+// isPostgres returns true if the config uses the postgres adapter (the default)
+func isPostgres(config map[string]string) bool {
+	return dialectFor(config).Name() == AdapterPostgres
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLockTimeout tests reading the time to wait for the migration lock from config
+func TestLockTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		timeout time.Duration
+	}{
+		{"", migrateLockTimeout * time.Second},
+		{"soon", migrateLockTimeout * time.Second},
+		{"5", 5 * time.Second},
+		{"0", 0},
+	}
+
+	for _, test := range tests {
+		timeout := lockTimeout(map[string]string{"migrate_lock_timeout": test.value})
+		if timeout != test.timeout {
+			t.Fatalf("Failed to read lock timeout %q expected:%s result:%s", test.value, test.timeout, timeout)
+		}
+	}
+}
+
+// TestAdvisoryLockKeys tests splitting the advisory lock key as pg_locks shows it
+func TestAdvisoryLockKeys(t *testing.T) {
+	classid, objid := advisoryLockKeys()
+	if classid != 0x66726167 || objid != 0x6d656e74 {
+		t.Fatalf("Failed to split lock key result:%x %x", classid, objid)
+	}
+	if classid<<32|objid != migrateLockKey {
+		t.Fatalf("Failed to split lock key into halves of %x", migrateLockKey)
+	}
+}
+
+// TestLockRow tests that the lock row used for databases other than postgres
+// can only be taken by one process at a time
+func TestLockRow(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "fragmenta-lock")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+	db := filepath.Join(dir, "app.sqlite")
+
+	// Run sql with the ? placeholders replaced by args, as the sqlite3 command cannot bind them
+	run := func(sql string, args ...string) (string, error) {
+		for _, arg := range args {
+			sql = strings.Replace(sql, "?", quoteSQL(arg), 1)
+		}
+		output, err := exec.Command("sqlite3", "-bail", db, lockTableSQL+sql).CombinedOutput()
+		return strings.TrimSpace(string(output)), err
+	}
+
+	if _, err := run(lockRowSQL, migrateLockName, "first", "2016-01-01T12:00:00Z"); err != nil {
+		t.Fatalf("Failed to take lock %s", err)
+	}
+	if _, err := run(lockRowSQL, migrateLockName, "second", "2016-01-01T12:00:01Z"); err == nil {
+		t.Fatalf("Failed to refuse lock held by another process")
+	}
+
+	holder, err := run(lockRowHolderSQL, migrateLockName)
+	if err != nil || holder != "first|2016-01-01T12:00:00Z" {
+		t.Fatalf("Failed to read lock holder %v result:%s", err, holder)
+	}
+	if !strings.HasPrefix(rowLockHolder("first", "2016-01-01T12:00:00Z"), "first (locked at 2016-01-01T12:00:00Z") {
+		t.Fatalf("Failed to describe lock holder")
+	}
+
+	// Only the holder releases the lock
+	run(unlockRowSQL, migrateLockName, "second")
+	if _, err := run(lockRowSQL, migrateLockName, "second", "2016-01-01T12:00:02Z"); err == nil {
+		t.Fatalf("Failed to keep lock released by another process")
+	}
+
+	run(unlockRowSQL, migrateLockName, "first")
+	if _, err := run(lockRowSQL, migrateLockName, "second", "2016-01-01T12:00:03Z"); err != nil {
+		t.Fatalf("Failed to take released lock %s", err)
+	}
+}
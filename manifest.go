@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/fragmenta/query"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// The extension of the manifest written beside each backup archive
+const manifestExtension = ".json"
+
+// backupManifest describes a backup archive, and is written beside it as json
+// so that the archive can be checked before it is restored
+type backupManifest struct {
+	// The hex encoded SHA-256 of the archive
+	SHA256 string `json:"sha256"`
+	// The size of the archive in bytes
+	Size int64 `json:"size"`
+	// The database backed up
+	DB string `json:"db"`
+	// The mode of the database backed up
+	Mode string `json:"mode"`
+	// The db_adapter of the database backed up
+	Adapter string `json:"adapter"`
+	// The version of fragmenta which made the backup
+	FragmentaVersion string `json:"fragmenta_version"`
+	// The latest migration applied to the database when it was backed up
+	Migration string `json:"migration"`
+	// The time the backup was made
+	CreatedAt time.Time `json:"created_at"`
+	// True if the data was masked with db/mask.json
+	Sanitized bool `json:"sanitized,omitempty"`
+	// The tables backed up, if not all of them
+	Tables []string `json:"tables,omitempty"`
+}
+
+// manifestPath returns the path of the manifest for the archive at path
+func manifestPath(path string) string {
+	return path + manifestExtension
+}
+
+// fileChecksum returns the hex encoded SHA-256 and size of the file at path
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// latestMigration returns the newest migration by name recorded in fragmenta_metadata
+// on the database in config, or an empty string if there is none. Migrations may be applied
+// out of order, so this is not always the last one applied.
+func latestMigration(config map[string]string) (string, error) {
+	err := openDatabase(config)
+	if err != nil {
+		return "", err
+	}
+	defer query.CloseDatabase()
+
+	applied, err := readMetadata(config)
+	if err != nil {
+		return "", err
+	}
+	return newestMigration(applied), nil
+}
+
+// newestMigration returns the name in applied which sorts last, or an empty string if there are none
+func newestMigration(applied []string) string {
+	newest := ""
+	for _, name := range applied {
+		if name > newest {
+			newest = name
+		}
+	}
+	return newest
+}
+
+// writeManifest writes the manifest for the archive at path, a backup of the database in config,
+// adding the details of the archive and database to manifest
+func writeManifest(config map[string]string, path string, manifest backupManifest) error {
+	sum, size, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+
+	migration, err := latestMigration(config)
+	if err != nil {
+		return err
+	}
+
+	manifest.SHA256 = sum
+	manifest.Size = size
+	manifest.DB = config["db"]
+	manifest.Adapter = dialectFor(config).Name()
+	manifest.FragmentaVersion = fragmentaVersion
+	manifest.Migration = migration
+	manifest.CreatedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(manifestPath(path), append(data, '\n'), 0600)
+}
+
+// readManifest reads the manifest for the archive at path, returning nil if it has none
+func readManifest(path string) (*backupManifest, error) {
+	if !fileExists(manifestPath(path)) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(manifestPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &backupManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s %s", manifestPath(path), err)
+	}
+	return manifest, nil
+}
+
+// check returns an error if the archive at path does not match this manifest
+func (m *backupManifest) check(path string) error {
+	sum, size, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+
+	if size != m.Size {
+		return fmt.Errorf("backup %s is %d bytes, but its manifest records %d bytes", path, size, m.Size)
+	}
+
+	if sum != m.SHA256 {
+		return fmt.Errorf("backup %s does not match the checksum in its manifest", path)
+	}
+
+	return nil
+}
+
+// newerMigration returns true if the migration in this manifest is newer than
+// every migration in migrations (sorted by name), so the backup was made by newer code
+func (m *backupManifest) newerMigration(migrations []*migration) bool {
+	if m.Migration == "" {
+		return false
+	}
+
+	for _, f := range migrations {
+		if f.name >= m.Migration {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyBackups checks the backup at path against its manifest, or every backup in store
+// if path is empty, printing the result for each. Backups in stores which are not local
+// are downloaded to be checked. It returns false if any backup fails.
+func verifyBackups(store backupStore, path string) bool {
+	var paths []string
+	if path != "" {
+		paths = append(paths, path)
+	} else {
+		backups, err := readBackups(store)
+		if err != nil {
+			log.Printf("Error reading backups %s", err)
+			return false
+		}
+		for _, b := range backups {
+			paths = append(paths, b.path)
+		}
+	}
+
+	if len(paths) == 0 {
+		log.Printf("No backups found in %s", store)
+		return true
+	}
+
+	verified, failed := 0, 0
+	for _, name := range paths {
+		p, cleanup := name, func() {}
+		var err error
+		if path == "" {
+			p, cleanup, err = fetchBackup(store, name)
+		}
+
+		var manifest *backupManifest
+		if err == nil {
+			manifest, err = readManifest(p)
+		}
+		if err == nil && manifest == nil {
+			if path != "" {
+				err = fmt.Errorf("no manifest found at %s", manifestPath(p))
+			} else {
+				// Older backups were made without manifests
+				fmt.Printf("skip\t%s\tno manifest\n", name)
+				cleanup()
+				continue
+			}
+		}
+		if err == nil {
+			err = manifest.check(p)
+		}
+		if cleanup != nil {
+			cleanup()
+		}
+
+		if err != nil {
+			fmt.Printf("FAIL\t%s\t%s\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok\t%s\t%s\t%s\n", name, manifest.DB, manifest.Migration)
+		verified++
+	}
+
+	if failed > 0 {
+		log.Printf("%d of %d backups failed verification", failed, verified+failed)
+		return false
+	}
+
+	log.Printf("Verified %d backups", verified)
+	return true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestManifestCheck tests checking backup archives against their manifests
+func TestManifestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fragmenta-manifest")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "2016-03-10-09-00-app.sql.gz")
+	err = ioutil.WriteFile(path, []byte("archive"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write archive %s", err)
+	}
+
+	manifest, err := readManifest(path)
+	if err != nil || manifest != nil {
+		t.Fatalf("Failed to read missing manifest as nil %v %s", manifest, err)
+	}
+
+	sum, size, err := fileChecksum(path)
+	if err != nil || size != 7 {
+		t.Fatalf("Failed to checksum archive size:%d %s", size, err)
+	}
+
+	data, _ := json.Marshal(backupManifest{SHA256: sum, Size: size, DB: "app", Migration: "2016-03-01-120000-Create-pages.sql"})
+	err = ioutil.WriteFile(manifestPath(path), data, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write manifest %s", err)
+	}
+
+	manifest, err = readManifest(path)
+	if err != nil || manifest == nil || manifest.DB != "app" {
+		t.Fatalf("Failed to read manifest %v %s", manifest, err)
+	}
+
+	err = manifest.check(path)
+	if err != nil {
+		t.Fatalf("Failed to check archive %s", err)
+	}
+
+	// Archives changed without changing size, or truncated, should fail
+	for _, content := range []string{"archivf", "archiv"} {
+		ioutil.WriteFile(path, []byte(content), 0600)
+		if manifest.check(path) == nil {
+			t.Fatalf("Failed to reject changed archive %s", content)
+		}
+	}
+}
+
+// TestNewerMigration tests detecting backups made at a migration newer than those on disk
+func TestNewerMigration(t *testing.T) {
+	migrations := []*migration{
+		{name: "2016-01-01-120000-Create-Database.sql"},
+		{name: "2016-03-01-120000-Create-pages.sql"},
+	}
+
+	tests := map[string]bool{
+		"":                                      false,
+		"2016-01-01-120000-Create-Database.sql": false,
+		"2016-03-01-120000-Create-pages.sql":    false,
+		"2016-03-02-120000-Create-users.sql":    true,
+	}
+
+	for version, newer := range tests {
+		m := &backupManifest{Migration: version}
+		if m.newerMigration(migrations) != newer {
+			t.Fatalf("Failed to compare migration:%s expected newer:%t", version, newer)
+		}
+	}
+}
+
+// TestNewestMigration tests finding the newest migration applied when they were applied out of order
+func TestNewestMigration(t *testing.T) {
+	// Metadata is read in the order applied, newest first
+	applied := []string{"2016-02-01-120000-Create-users.sql", "2016-03-01-120000-Create-pages.sql", "2016-01-01-120000-Create-Database.sql"}
+	if newestMigration(applied) != "2016-03-01-120000-Create-pages.sql" {
+		t.Fatalf("Failed to find newest migration result:%s", newestMigration(applied))
+	}
+
+	if newestMigration(nil) != "" {
+		t.Fatalf("Failed to find no migration for a new database")
+	}
+}
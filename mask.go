@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The rules used to mask column values
+const (
+	maskKeep     = "keep"
+	maskEmail    = "email"
+	maskHash     = "hash"
+	maskNull     = "null"
+	maskConstant = "constant:"
+)
+
+// The suffix added to the database in the names of backups masked with db/mask.json
+const sanitizedSuffix = "-sanitized"
+
+// isSanitized returns true if the backup was masked when it was made
+func (b backupFile) isSanitized() bool {
+	return strings.HasSuffix(b.db, sanitizedSuffix)
+}
+
+// maskRules sets the rule used to mask each column, by table and column name,
+// read from db/mask.json in the form {"users":{"email":"email","name":"constant:Jane"}}
+type maskRules map[string]map[string]string
+
+// maskPath returns the path of the masking config
+func maskPath(projectPath string) string {
+	return filepath.Join(projectPath, "db", "mask.json")
+}
+
+// readMaskRules reads the masking config from db/mask.json, returning nil if there is none
+func readMaskRules() (maskRules, error) {
+	path := maskPath(".")
+	if !fileExists(path) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules maskRules
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("error reading mask config %s %s", path, err)
+	}
+
+	return rules, rules.validate()
+}
+
+// validate checks every rule is known
+func (r maskRules) validate() error {
+	for table, columns := range r {
+		for column, rule := range columns {
+			switch rule {
+			case maskKeep, maskEmail, maskHash, maskNull:
+			default:
+				if !strings.HasPrefix(rule, maskConstant) {
+					return fmt.Errorf("invalid mask rule %q for %s.%s - use keep, email, hash, null or constant:value", rule, table, column)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// masker replaces the values of masked columns in sql dumps
+type masker struct {
+	rules maskRules
+	// A random key for hashing values, so that masked values cannot be reversed
+	// by hashing guesses, but are the same wherever a value appears in one dump
+	key []byte
+	// True if strings in the dump escape characters with backslashes, as mysql does
+	backslashEscapes bool
+	// True if line breaks in strings are written as char(10) joined with ||, as the sqlite dump does
+	charLineBreaks bool
+}
+
+// newMasker returns a masker for dumps made with adapter
+func newMasker(rules maskRules, adapter string) (*masker, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &masker{rules: rules, key: key, backslashEscapes: adapter == AdapterMysql, charLineBreaks: adapter == AdapterSqlite}, nil
+}
+
+// maskValue returns the value masked with rule, leaving NULL values as they are
+func (m *masker) maskValue(rule string, value string, null bool) (string, bool) {
+	if null || rule == maskKeep {
+		return value, null
+	}
+
+	switch rule {
+	case maskNull:
+		return "", true
+	case maskEmail:
+		return "user-" + m.hash(value)[:12] + "@example.com", false
+	case maskHash:
+		return m.hash(value), false
+	default:
+		return strings.TrimPrefix(rule, maskConstant), false
+	}
+}
+
+// hash returns the hex encoded keyed hash of value
+func (m *masker) hash(value string) string {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// columnRules returns the rule for each of columns in table, or nil if none of them are masked.
+// An error is returned if a column with a rule is missing, as the config may be wrong.
+func (m *masker) columnRules(table string, columns []string) ([]string, error) {
+	tableRules := m.rules[table]
+	if len(tableRules) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]string, len(columns))
+	masked := 0
+	for i, c := range columns {
+		rule, ok := tableRules[c]
+		if !ok {
+			rule = maskKeep
+		} else {
+			masked++
+		}
+		rules[i] = rule
+	}
+
+	if masked != len(tableRules) {
+		for c := range tableRules {
+			if !contains(c, columns) {
+				return nil, fmt.Errorf("masked column %s.%s not found in backup", table, c)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// maskCopyStart matches the start of a postgres COPY block
+var maskCopyStart = regexp.MustCompile(`^COPY ([^ ]+) \((.*)\) FROM stdin;$`)
+
+// maskInsert matches an insert statement with column names, as written by
+// the sqlite dump and by mysqldump --complete-insert
+var maskInsert = regexp.MustCompile(`^INSERT INTO ([^ ]+) \(([^)]*)\) VALUES (.*);$`)
+
+// maskSQL copies the sql dump read from in to out, masking the values of columns
+// with rules in postgres COPY blocks and in insert statements, line by line
+func maskSQL(in io.Reader, out io.Writer, m *masker) error {
+	r := bufio.NewReaderSize(in, 64*1024)
+	w := bufio.NewWriter(out)
+
+	// The rules for the current COPY block, if any
+	copying := false
+	var copyRules []string
+
+	for {
+		line, readErr := r.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if line == "" {
+			break
+		}
+
+		var err error
+		text := strings.TrimSuffix(line, "\n")
+		switch {
+		case copying:
+			if text == `\.` {
+				copying = false
+			} else if copyRules != nil {
+				line = m.maskCopyRow(text, copyRules) + "\n"
+			}
+		case strings.HasPrefix(text, "COPY "):
+			match := maskCopyStart.FindStringSubmatch(text)
+			if match != nil {
+				copying = true
+				copyRules, err = m.columnRules(unquoteIdentifier(match[1]), splitIdentifiers(match[2]))
+			}
+		case strings.HasPrefix(text, "INSERT INTO "):
+			line, err = m.maskInsertLine(text, line)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = w.WriteString(line)
+		if err != nil {
+			return err
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	return w.Flush()
+}
+
+// maskCopyRow masks the tab separated values in one row of a postgres COPY block
+func (m *masker) maskCopyRow(row string, rules []string) string {
+	fields := strings.Split(row, "\t")
+	for i, rule := range rules {
+		if i >= len(fields) || rule == maskKeep {
+			continue
+		}
+
+		null := fields[i] == `\N`
+		value, null := m.maskValue(rule, unescapeCopy(fields[i]), null)
+		if null {
+			fields[i] = `\N`
+		} else {
+			fields[i] = escapeCopy(value)
+		}
+	}
+	return strings.Join(fields, "\t")
+}
+
+// maskInsertLine masks the values in an insert statement for a table with rules,
+// returning line unchanged if the table has none
+func (m *masker) maskInsertLine(text string, line string) (string, error) {
+	fields := strings.Fields(strings.TrimPrefix(text, "INSERT INTO "))
+	if len(fields) == 0 {
+		return line, nil
+	}
+
+	table := unquoteIdentifier(fields[0])
+	if len(m.rules[table]) == 0 {
+		return line, nil
+	}
+
+	match := maskInsert.FindStringSubmatch(text)
+	if match == nil {
+		return "", fmt.Errorf("cannot mask insert into %s without column names", table)
+	}
+
+	rules, err := m.columnRules(table, splitIdentifiers(match[2]))
+	if err != nil || rules == nil {
+		return line, err
+	}
+
+	rows, err := parseInsertValues(match[3], m.backslashEscapes)
+	if err != nil {
+		return "", fmt.Errorf("cannot mask insert into %s %s", table, err)
+	}
+
+	tuples := make([]string, len(rows))
+	for r, row := range rows {
+		for i, rule := range rules {
+			if i >= len(row) || rule == maskKeep {
+				continue
+			}
+
+			value, null := m.maskValue(rule, m.unquoteValue(row[i]), row[i] == "NULL")
+			if null {
+				row[i] = "NULL"
+			} else {
+				row[i] = m.quoteValue(value)
+			}
+		}
+		tuples[r] = "(" + strings.Join(row, ",") + ")"
+	}
+
+	prefix := strings.TrimSuffix(text, match[3]+";")
+	return prefix + strings.Join(tuples, ",") + ";\n", nil
+}
+
+// parseInsertValues splits the values of an insert statement, such as (1,'a'),(2,'b'),
+// into the literal text of each value in each row
+func parseInsertValues(s string, backslashEscapes bool) ([][]string, error) {
+	var rows [][]string
+
+	i := 0
+	for i < len(s) {
+		if s[i] != '(' {
+			return nil, fmt.Errorf("unexpected %q in values", s[i])
+		}
+
+		var row []string
+		start, depth := i+1, 0
+		for i++; i < len(s); i++ {
+			c := s[i]
+			if c == '\'' {
+				i = closingQuote(s, i, backslashEscapes)
+				if i == -1 {
+					return nil, fmt.Errorf("unterminated string in values")
+				}
+			} else if c == '(' {
+				depth++
+			} else if c == ')' && depth > 0 {
+				depth--
+			} else if (c == ',' || c == ')') && depth == 0 {
+				row = append(row, strings.TrimSpace(s[start:i]))
+				start = i + 1
+				if c == ')' {
+					break
+				}
+			}
+		}
+		if i >= len(s) {
+			return nil, fmt.Errorf("unterminated row in values")
+		}
+		rows = append(rows, row)
+
+		// Skip the closing bracket and any separator before the next row
+		i++
+		if i < len(s) && s[i] == ',' {
+			i++
+		}
+	}
+
+	return rows, nil
+}
+
+// closingQuote returns the index of the quote ending the string which starts at i, or -1
+func closingQuote(s string, i int, backslashEscapes bool) int {
+	for j := i + 1; j < len(s); j++ {
+		switch {
+		case s[j] == '\\' && backslashEscapes:
+			j++
+		case s[j] == '\'' && j+1 < len(s) && s[j+1] == '\'':
+			j++
+		case s[j] == '\'':
+			return j
+		}
+	}
+	return -1
+}
+
+// unquoteValue returns the contents of a quoted sql string literal,
+// or the literal itself for numbers and other values
+func (m *masker) unquoteValue(literal string) string {
+	if m.charLineBreaks {
+		value, ok := unquoteText(literal)
+		if !ok {
+			return literal
+		}
+		return value
+	}
+
+	if len(literal) < 2 || literal[0] != '\'' || literal[len(literal)-1] != '\'' {
+		return literal
+	}
+
+	value := literal[1 : len(literal)-1]
+	if m.backslashEscapes {
+		value = mysqlUnescaper.Replace(value)
+	}
+	return strings.Replace(value, "''", "'", -1)
+}
+
+// quoteValue returns value as a quoted sql string literal
+func (m *masker) quoteValue(value string) string {
+	if m.charLineBreaks {
+		return quoteText(value)
+	}
+	if m.backslashEscapes {
+		value = strings.Replace(value, `\`, `\\`, -1)
+	}
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// mysqlUnescaper replaces the backslash escapes used in mysql string literals
+var mysqlUnescaper = strings.NewReplacer(`\0`, "\x00", `\'`, "'", `\"`, `"`, `\b`, "\b", `\n`, "\n", `\r`, "\r", `\t`, "\t", `\Z`, "\x1a", `\\`, `\`)
+
+// copyUnescaper replaces the backslash escapes used in postgres COPY data
+var copyUnescaper = strings.NewReplacer(`\\`, `\`, `\b`, "\b", `\f`, "\f", `\n`, "\n", `\r`, "\r", `\t`, "\t", `\v`, "\v")
+
+// copyEscaper escapes values for postgres COPY data
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// unescapeCopy returns the value of a field in postgres COPY data
+func unescapeCopy(field string) string {
+	return copyUnescaper.Replace(field)
+}
+
+// escapeCopy returns value escaped as a field in postgres COPY data
+func escapeCopy(value string) string {
+	return copyEscaper.Replace(value)
+}
+
+// unquoteIdentifier returns a table name without schema or quotes, e.g. public.users or `users` becomes users
+func unquoteIdentifier(name string) string {
+	i := strings.LastIndex(name, ".")
+	if i != -1 {
+		name = name[i+1:]
+	}
+	return strings.Trim(name, "\"`")
+}
+
+// splitIdentifiers returns the unquoted column names in a comma separated list
+func splitIdentifiers(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		names = append(names, strings.Trim(strings.TrimSpace(name), "\"`"))
+	}
+	return names
+}
+
+// newMaskReader returns a reader of the sql read from r with values masked
+func newMaskReader(r io.Reader, m *masker) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(maskSQL(r, pw, m))
+	}()
+	return pr
+}
+
+// backupMode returns the mode a backup was made in, from its manifest, or by matching
+// the database in its name with the database for each mode, or an empty string if unknown
+func backupMode(path string, manifest *backupManifest) string {
+	if manifest != nil && manifest.Mode != "" {
+		return manifest.Mode
+	}
+
+	name := filepath.Base(path)
+	for _, mode := range []string{ModeDevelopment, ModeProduction, ModeTest} {
+		config := configForMode(mode)
+		if config["db"] != "" && strings.HasSuffix(strings.TrimSuffix(strings.TrimSuffix(name, encryptedExtension), ".sql.gz"), "-"+backupName(config)) {
+			return mode
+		}
+	}
+	return ""
+}
+
+// restoreMasker returns a masker to restore the backup at path into the database in config for mode,
+// or nil if the backup was made in the same mode or has been sanitized already
+func restoreMasker(config map[string]string, mode string, path string, manifest *backupManifest) (*masker, error) {
+	if manifest != nil && manifest.Sanitized {
+		return nil, nil
+	}
+
+	source := backupMode(path, manifest)
+	if source == mode {
+		return nil, nil
+	}
+	if source == "" {
+		source = "unknown"
+	}
+
+	rules, err := readMaskRules()
+	if err != nil {
+		return nil, err
+	}
+
+	if rules == nil {
+		log.Printf("WARNING: restoring a backup from %s into %s without masking, add %s to mask personal data", source, mode, maskPath("."))
+		return nil, nil
+	}
+
+	log.Printf("Masking data from %s backup with %s", source, maskPath("."))
+	return newMasker(rules, dialectFor(config).Name())
+}
+
+// sanitizeMasker returns a masker for backups of the database in config, which requires db/mask.json
+func sanitizeMasker(config map[string]string) (*masker, error) {
+	rules, err := readMaskRules()
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		return nil, fmt.Errorf("no mask config found at %s", maskPath("."))
+	}
+	return newMasker(rules, dialectFor(config).Name())
+}
+
+// dumpMasked dumps the database in config (or only tables if given) to w, masking the sql with m as it is dumped
+func dumpMasked(config map[string]string, tables []string, w io.Writer, m *masker) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(dialectFor(config).Dump(config, tables, pw))
+	}()
+
+	err := maskSQL(pr, w, m)
+	// Stop the dump if masking failed
+	pr.CloseWithError(err)
+	return err
+}
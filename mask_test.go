@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testMasker returns a masker for tests with a fixed key
+func testMasker(backslashEscapes bool) *masker {
+	rules := maskRules{
+		"users": {
+			"email":    maskEmail,
+			"password": maskHash,
+			"phone":    maskNull,
+			"name":     maskConstant + "Jane",
+			"id":       maskKeep,
+		},
+	}
+	return &masker{rules: rules, key: []byte("test"), backslashEscapes: backslashEscapes}
+}
+
+// TestMaskSQL tests masking values in postgres, mysql and sqlite dumps
+func TestMaskSQL(t *testing.T) {
+	m := testMasker(false)
+	email, _ := m.maskValue(maskEmail, "a@b.com", false)
+	hash, _ := m.maskValue(maskHash, "secret", false)
+
+	if !strings.HasPrefix(email, "user-") || !strings.HasSuffix(email, "@example.com") || len(hash) != 64 {
+		t.Fatalf("Failed to mask values email:%s hash:%s", email, hash)
+	}
+
+	tests := []struct {
+		backslashEscapes bool
+		sql              string
+		expected         string
+	}{
+		{
+			false,
+			"COPY public.users (id, email, password, phone, name) FROM stdin;\n1\ta@b.com\tsecret\t555\tBob\n2\t\\N\tsecret\t\\N\tAl\\tB\n\\.\nCOPY public.pages (id, email) FROM stdin;\n1\ta@b.com\n\\.\n",
+			"COPY public.users (id, email, password, phone, name) FROM stdin;\n1\t" + email + "\t" + hash + "\t\\N\tJane\n2\t\\N\t" + hash + "\t\\N\tJane\n\\.\nCOPY public.pages (id, email) FROM stdin;\n1\ta@b.com\n\\.\n",
+		},
+		{
+			false,
+			"INSERT INTO \"users\" (\"id\",\"email\",\"password\",\"phone\",\"name\") VALUES (1,'a@b.com','secret','555','O''Brien, Bob');\nINSERT INTO \"pages\" (\"id\",\"email\") VALUES (1,'a@b.com');\n",
+			"INSERT INTO \"users\" (\"id\",\"email\",\"password\",\"phone\",\"name\") VALUES (1,'" + email + "','" + hash + "',NULL,'Jane');\nINSERT INTO \"pages\" (\"id\",\"email\") VALUES (1,'a@b.com');\n",
+		},
+		{
+			true,
+			"INSERT INTO `users` (`id`, `email`, `password`, `phone`, `name`) VALUES (1,'a@b.com','secret',NULL,'it\\'s (me), \\\\'),(2,'a@b.com','secret','555','x');",
+			"INSERT INTO `users` (`id`, `email`, `password`, `phone`, `name`) VALUES (1,'" + email + "','" + hash + "',NULL,'Jane'),(2,'" + email + "','" + hash + "',NULL,'Jane');\n",
+		},
+	}
+
+	for _, test := range tests {
+		m.backslashEscapes = test.backslashEscapes
+		var out bytes.Buffer
+		err := maskSQL(strings.NewReader(test.sql), &out, m)
+		if err != nil || out.String() != test.expected {
+			t.Fatalf("Failed to mask sql %s\nexpected:\n%s\nresult:\n%s", err, test.expected, out.String())
+		}
+	}
+}
+
+// TestMaskSQLLineBreaks tests masking sqlite inserts with line breaks in text
+func TestMaskSQLLineBreaks(t *testing.T) {
+	m := testMasker(false)
+	m.charLineBreaks = true
+	hash, _ := m.maskValue(maskHash, "secret\nphrase", false)
+
+	columns := "INSERT INTO \"users\" (\"id\",\"email\",\"password\",\"phone\",\"name\") VALUES "
+	sql := columns + "(1,NULL,'secret'||char(10)||'phrase',NULL,'line one'||char(10)||'line two');\n"
+	expected := columns + "(1,NULL,'" + hash + "',NULL,'Jane');\n"
+
+	var out bytes.Buffer
+	err := maskSQL(strings.NewReader(sql), &out, m)
+	if err != nil || out.String() != expected {
+		t.Fatalf("Failed to mask multi-line text %s\nexpected:\n%s\nresult:\n%s", err, expected, out.String())
+	}
+
+	if m.quoteValue("a\nb") != "'a'||char(10)||'b'" {
+		t.Fatalf("Failed to quote multi-line value result:%s", m.quoteValue("a\nb"))
+	}
+}
+
+// TestMaskSQLErrors tests that dumps which cannot be masked are rejected
+func TestMaskSQLErrors(t *testing.T) {
+	m := testMasker(true)
+
+	for _, sql := range []string{
+		"INSERT INTO `users` VALUES (1,'a@b.com');\n",
+		"INSERT INTO `users` (`id`, `email`) VALUES (1,'a@b.com');\n",
+		"INSERT INTO `users` (`id`, `email`, `password`, `phone`, `name`) VALUES (1,'a@b.com','secret',NULL,'it\\');\n",
+		"COPY public.users (id, mail) FROM stdin;\n\\.\n",
+	} {
+		var out bytes.Buffer
+		if maskSQL(strings.NewReader(sql), &out, m) == nil {
+			t.Fatalf("Failed to reject sql %s", sql)
+		}
+	}
+
+	rules := maskRules{"users": {"email": "fake"}}
+	if rules.validate() == nil {
+		t.Fatalf("Failed to reject unknown mask rule")
+	}
+}
+
+// TestCopyEscapes tests escaping values in postgres COPY data
+func TestCopyEscapes(t *testing.T) {
+	values := []string{"plain", "tab\tnew\nline", `back\slash`, "\\N"}
+	for _, v := range values {
+		if unescapeCopy(escapeCopy(v)) != v {
+			t.Fatalf("Failed to escape copy value %q result:%q", v, escapeCopy(v))
+		}
+	}
+
+	if unquoteIdentifier("public.users") != "users" || unquoteIdentifier("`users`") != "users" {
+		t.Fatalf("Failed to unquote identifiers")
+	}
+}
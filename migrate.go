@@ -1,97 +1,961 @@
 package main
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"github.com/fragmenta/query"
+	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
-// RunMigrate runs all pending migrations
+const (
+	// The suffix used for paired down migration files
+	migrationDownSuffix = ".down.sql"
+
+	// The marker line which separates up and down sql within one migration file
+	migrationDownMarker = "-- +down"
+
+	// The marker line for migrations which cannot run within a transaction
+	// e.g. CREATE INDEX CONCURRENTLY
+	migrationNoTransactionMarker = "-- +notransaction"
+
+	// The marker prefix for lines in a baseline migration naming the migrations it replaced
+	migrationSquashedMarker = "-- +squashed "
+
+	// Directions in which migrations are run
+	migrateUp   = "up"
+	migrateDown = "down"
+)
+
+// migration represents one migration file in db/migrate
+type migration struct {
+	// The file name, which is recorded as migration_version in fragmenta_metadata
+	name string
+	// The path of the up migration file
+	path string
+	// The sql to apply the migration
+	up string
+	// The sql to revert the migration (may be empty)
+	down string
+	// Set if the migration cannot run within a transaction
+	noTransaction bool
+	// The SHA-256 of the migration file, recorded when the migration is applied
+	checksum string
+	// Set if this is a migration written in Go rather than sql
+	goMigration bool
+	// The migrations replaced by this baseline migration (if any)
+	squashed []string
+}
+
+// migrateOptions holds the options set by flags for the migrate commands
+type migrateOptions struct {
+	// The version to migrate up or down to
+	to string
+	// Print the sql which would be run without changing the database
+	dryRun bool
+	// Write the dry run plan to this file
+	planPath string
+	// Run migrations with the psql client rather than the query package
+	psql bool
+	// Write the schema to db/schema.sql after migrating
+	schema bool
+}
+
+// metadata represents one row of the fragmenta_metadata table
+type metadata struct {
+	// The migration file name
+	migrationVersion string
+	// The version of fragmenta which recorded the migration
+	fragmentaVersion string
+	// The time the migration was recorded, as text because drivers differ in how they return it
+	updatedAt sql.NullString
+	// The SHA-256 of the migration file when it was applied (empty for older records)
+	checksum string
+}
+
+// sql returns the sql to run this migration in direction
+func (m *migration) sql(direction string) string {
+	if direction == migrateDown {
+		return m.down
+	}
+	return m.up
+}
+
+// canRevert returns true if this migration has a down migration with sql to run,
+// so that a generated down file holding only a comment is not treated as one.
+// Only whether there are statements matters here, not where they split, so any adapter will do.
+func (m *migration) canRevert() bool {
+	return m.goMigration || len(splitSQL(m.down, AdapterPostgres)) > 0
+}
+
+// createsDatabase returns true if this migration creates the database,
+// and so must be run without connecting to the database
+func (m *migration) createsDatabase() bool {
+	return strings.Contains(m.name, createDatabaseMigrationName)
+}
+
+// RunMigrate runs the migrate subcommands
+// Expects:
+// - migrate [mode] - runs all pending migrations
+// - migrate [mode] --to version - runs pending migrations up to version, or reverts those after it
+// - migrate down [n] [mode] - reverts the last n migrations (default 1)
+// - migrate down [mode] --to version - reverts migrations applied after version
+// - migrate redo [mode] - reverts the last migration and runs it again
+// - migrate status [mode] - lists applied, pending and orphaned migrations
+// - migrate verify [mode] - lists applied migrations whose files have changed
+// - migrate squash --before version [mode] - replaces the migrations before version with a baseline schema
+// Migrations up or down accept --dry-run to print the sql without running it,
+// and --plan file.sql to write that sql to a file.
+// Migrations run through the query package unless --psql is given or migrate_client is psql in config.
+// In development, the schema is written to db/schema.sql after migrating.
 func RunMigrate(args []string) {
 
-	// Remove fragmenta backup from args list
-	args = args[2:]
+	// Remove fragmenta migrate from args list
+	args, flags := parseArgs(args[2:], "dry-run", "psql")
+
+	options := migrateOptions{
+		to:       flags["to"],
+		dryRun:   flags["dry-run"] == "true" || flags["plan"] != "",
+		planPath: flags["plan"],
+		psql:     flags["psql"] == "true",
+	}
+
+	command := ""
+	if len(args) > 0 {
+		switch args[0] {
+		case "up", "down", "redo", "status", "verify", "squash":
+			command = args[0]
+			args = args[1:]
+		}
+	}
+
+	// Down accepts a number of migrations before the mode
+	n := 1
+	if command == "down" && len(args) > 0 {
+		i, err := strconv.Atoi(args[0])
+		if err == nil {
+			n = i
+			args = args[1:]
+		}
+	}
+
+	// Commands use the config for the mode, which may ask for the psql client
+	mode := fragmentaConfig(args)
+	config := configForMode(mode)
+
+	// Keep db/schema.sql up to date with the development database
+	options.schema = mode == ModeDevelopment
+	if config["migrate_client"] == "psql" {
+		options.psql = true
+	}
+	if options.psql && dialectFor(config).Name() != AdapterPostgres {
+		log.Printf("Error - psql can only be used with the %s adapter", AdapterPostgres)
+		return
+	}
+
+	switch command {
+	case "down":
+		rollbackDB(config, n, options)
+	case "redo":
+		redo := migrateOptions{psql: options.psql, schema: options.schema}
+		if rollbackDB(config, 1, redo) {
+			migrateDB(config, redo)
+		}
+	case "status":
+		// Exit with an error status if any migrations are pending or status failed
+		pending := statusDB(config)
+		if pending != 0 {
+			os.Exit(1)
+		}
+	case "verify":
+		// Exit with an error status if any migrations have drifted or verify failed
+		drifted := verifyDB(config)
+		if drifted != 0 {
+			os.Exit(1)
+		}
+	case "squash":
+		if flags["before"] == "" {
+			log.Printf("Error - squash requires --before version")
+			return
+		}
+		squashMigrations(config, flags["before"], options)
+	default:
+		migrateDB(config, options)
+	}
+
+}
+
+// readMigrations reads all the migrations in db/migrate, sorted by name.
+// Down sql is read from a paired .down.sql file, or from the section after
+// a -- +down line within the migration file itself.
+func readMigrations() ([]*migration, error) {
+	var migrations []*migration
+
+	// Get a list of migration files, both sql and Go
+	files, err := filepath.Glob(filepath.Join(dbMigratePath("."), "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	goFiles, err := goMigrationFiles(dbMigratePath("."))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, goFiles...)
+
+	// Sort the list alphabetically
+	sort.Strings(files)
 
-	switch fragmentaConfig(args) {
-	case ModeProduction:
-		migrateDB(ConfigProduction)
-	case ModeTest:
-		migrateDB(ConfigTest)
+	for _, file := range files {
+		// Skip paired down files, they are read with their up migration
+		if strings.HasSuffix(file, migrationDownSuffix) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasSuffix(file, ".go") {
+			migrations = append(migrations, &migration{
+				name:        filepath.Base(file),
+				path:        file,
+				checksum:    checksum(data),
+				goMigration: true,
+			})
+			continue
+		}
+
+		m := parseMigration(filepath.Base(file), string(data))
+		m.path = file
+		m.checksum = checksum(data)
+
+		downFile := strings.TrimSuffix(file, ".sql") + migrationDownSuffix
+		if fileExists(downFile) {
+			data, err = ioutil.ReadFile(downFile)
+			if err != nil {
+				return nil, err
+			}
+			m.down = string(data)
+		}
+
+		migrations = append(migrations, m)
+	}
+
+	return migrations, nil
+}
+
+// parseMigration splits the sql for a migration into up and down sections,
+// and checks for the -- +notransaction and -- +squashed markers
+func parseMigration(name string, sql string) *migration {
+	m := &migration{name: name, up: sql}
+
+	lines := strings.Split(sql, "\n")
+	for _, line := range lines {
+		if strings.TrimSpace(line) == migrationNoTransactionMarker {
+			m.noTransaction = true
+		}
+		if strings.HasPrefix(line, migrationSquashedMarker) {
+			m.squashed = append(m.squashed, strings.TrimSpace(strings.TrimPrefix(line, migrationSquashedMarker)))
+		}
+	}
+
+	for i, line := range lines {
+		if strings.TrimSpace(line) == migrationDownMarker {
+			m.up = strings.Join(lines[:i], "\n")
+			m.down = strings.Join(lines[i+1:], "\n")
+			break
+		}
+	}
+
+	// Database creation cannot run within a transaction
+	if m.createsDatabase() {
+		m.noTransaction = true
+	}
+
+	return m
+}
+
+// checksum returns the hex encoded SHA-256 of data
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// driftedMigrations returns the names of applied migrations
+// whose files no longer match the checksum recorded when they were applied
+func driftedMigrations(migrations []*migration, records []metadata) []string {
+	var drifted []string
+
+	for _, r := range records {
+		// Records made before checksums were stored cannot be checked
+		if r.checksum == "" {
+			continue
+		}
+
+		m := findMigration(r.migrationVersion, migrations)
+		if m != nil && m.checksum != r.checksum {
+			drifted = append(drifted, m.name)
+		}
+	}
+
+	sort.Strings(drifted)
+	return drifted
+}
+
+// matchMigration returns the migration whose name starts with version,
+// so that a timestamp prefix is enough to identify a migration
+func matchMigration(version string, migrations []*migration) (*migration, error) {
+	var matches []*migration
+
+	for _, m := range migrations {
+		if m.name == version || m.name == version+".sql" {
+			return m, nil
+		}
+		if strings.HasPrefix(m.name, version) {
+			matches = append(matches, m)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no migration found matching %s", version)
+	case 1:
+		return matches[0], nil
 	default:
-		migrateDB(ConfigDevelopment)
+		return nil, fmt.Errorf("%d migrations match %s, use a longer version", len(matches), version)
+	}
+}
+
+// appliedAfter returns the applied migrations (newest first) which sort after version
+func appliedAfter(version string, applied []string) []string {
+	var after []string
+	for _, name := range applied {
+		if name > version {
+			after = append(after, name)
+		}
+	}
+	return after
+}
+
+// findMigration returns the migration with this name, or nil if none is found
+func findMigration(name string, migrations []*migration) *migration {
+	for _, m := range migrations {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// runPsql executes sql using the psql client, stopping at the first error
+func runPsql(sql string, args ...string) error {
+	args = append([]string{"-v", "ON_ERROR_STOP=1"}, args...)
+
+	result, err := runCommandInput(sql, "psql", args...)
+	if err != nil || strings.Contains(string(result), "ERROR") {
+		if err == nil {
+			err = fmt.Errorf("\n%s", string(result))
+		} else {
+			err = fmt.Errorf("%s\n%s", err, string(result))
+		}
+		return err
+	}
+
+	log.Printf("%s", string(result))
+	return nil
+}
+
+// createDatabase runs a database creation migration, which must run before the database exists,
+// connected to the admin database given by adminConfig, then reopens the database in config
+func createDatabase(config map[string]string, m *migration, options migrateOptions) error {
+	log.Printf("Running database creation migration: %s", m.path)
+
+	if options.psql {
+		err := runPsql(m.up)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := reopenDatabase(adminConfig(config))
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range splitSQL(m.up, dialectFor(config).Name()) {
+			_, err = query.ExecSQL(statement)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return reopenDatabase(config)
+}
+
+// runMigration executes the sql for this migration in direction against the database,
+// followed by the record sql to update fragmenta_metadata. Both are run in one transaction,
+// so that either both succeed or neither does, unless the migration opts out of transactions.
+// Statements are run through the query package, or with psql if options.psql is set.
+// Go migrations are compiled and run along with the record sql by runGoMigration.
+func runMigration(config map[string]string, m *migration, direction string, record string, options migrateOptions) error {
+
+	if options.psql && !m.goMigration {
+		return runPsql(migrationPlan(config, m, direction, record, options), "-d", config["db"])
+	}
+
+	// Run the migration, then make sure fragmenta_metadata is up to date before recording it
+	statements := splitSQL(m.sql(direction), dialectFor(config).Name())
+	if dialectFor(config).AddColumnSQL("fragmenta_metadata", "checksum", "text") == "" {
+		statements = append(statements, upgradeMetadataSQL(config)...)
+	}
+	statements = append(statements, splitSQL(record, dialectFor(config).Name())...)
+
+	if m.goMigration {
+		return runGoMigration(config, m, direction, statements)
+	}
+
+	return execStatements(statements, !m.noTransaction)
+}
+
+// execStatements executes statements in order on the open database,
+// within one transaction if transaction is true
+func execStatements(statements []string, transaction bool) error {
+	exec := func() error {
+		for _, statement := range statements {
+			_, err := query.ExecSQL(statement)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !transaction {
+		return exec()
+	}
+	return inTransaction(exec)
+}
+
+// inTransaction calls fn within a transaction on the open database,
+// which is committed if fn succeeds and rolled back if it fails
+func inTransaction(fn func() error) error {
+	_, err := query.ExecSQL("BEGIN;")
+	if err != nil {
+		return err
 	}
 
+	err = fn()
+	if err != nil {
+		_, rerr := query.ExecSQL("ROLLBACK;")
+		if rerr != nil {
+			log.Printf("Database ERROR rolling back %s", rerr)
+		}
+		return err
+	}
+
+	_, err = query.ExecSQL("COMMIT;")
+	return err
 }
 
 // migrateDB finds the last run migration, and run all those after it in order
 // We use the fragmenta_metadata table to do this
-func migrateDB(config map[string]string) {
+// If options.to is set, migrations are run up to and including that version,
+// or if it has already been applied, the migrations applied after it are reverted.
+// It returns false if any migration failed
+func migrateDB(config map[string]string, options migrateOptions) bool {
 	var migrations []string
 	var completed []string
+	var unrecorded []*migration
+	var plan []string
+	failed := false
 
 	// Get a list of migration files
-	files, err := filepath.Glob("./db/migrate/*.sql")
+	files, err := readMigrations()
 	if err != nil {
-		log.Printf("Error running restore %s", err)
-		return
+		log.Printf("Error reading migrations %s", err)
+		return false
 	}
 
-	// Sort the list alphabetically
-	sort.Strings(files)
+	var target *migration
+	if options.to != "" {
+		target, err = matchMigration(options.to, files)
+		if err != nil {
+			log.Printf("Error finding migration %s", err)
+			return false
+		}
+	}
+
+	// Release the migration lock when we finish, if we took it
+	locked := false
+	defer func() {
+		if locked {
+			unlockMigrations(config)
+		}
+	}()
 
 	// Try opening the db (db may not exist at this stage)
 	err = openDatabase(config)
-	if err != nil {
+	dbExists := (err == nil)
+	if !dbExists {
 		// if no db, proceed with empty migrations list
 		log.Printf("No database found")
 	} else {
-		migrations = readMetadata()
+		// Lock before reading metadata, so that concurrent runs cannot apply the same migrations
+		if !options.dryRun {
+			err = lockMigrations(config)
+			if err != nil {
+				log.Printf("ERROR locking migrations: %s", err)
+				return false
+			}
+			locked = true
+		}
+
+		records, err := readMetadataRecords(config)
+		if err != nil {
+			log.Printf("ERROR reading migrations applied: %s", err)
+			return false
+		}
+		for _, r := range records {
+			migrations = append(migrations, r.migrationVersion)
+		}
+
+		// Warn if applied migrations have been edited since
+		for _, name := range driftedMigrations(files, records) {
+			log.Printf("WARNING: migration %s has changed since it was applied", name)
+		}
+
+		// If the target has been applied, revert back to it instead
+		if target != nil && contains(target.name, migrations) {
+			return revertMigrations(config, files, appliedAfter(target.name, migrations), options)
+		}
 	}
 
-	for _, file := range files {
-		filename := filepath.Base(file)
+	for _, m := range files {
+		if contains(m.name, migrations) {
+			continue
+		}
+
+		// Databases migrated before a squash already have the baseline schema,
+		// but only if every migration it replaced was applied
+		if len(m.squashed) > 0 && dbExists && containsAny(m.squashed, migrations) {
+			missing := missingSquashed(m.squashed, migrations)
+			if len(missing) > 0 {
+				log.Printf("ERROR recording baseline migration %s - these migrations it replaced have not been applied: %s", m.name, strings.Join(missing, ", "))
+				log.Printf("All further migrations cancelled\n\n")
+				failed = true
+				break
+			}
 
-		if !contains(filename, migrations) {
-			log.Printf("Running migration %s", filename)
+			log.Printf("Squashed migrations applied, recording baseline %s as complete", m.name)
+			if options.dryRun {
+				plan = append(plan, fmt.Sprintf("-- Squashed migrations applied, record baseline %s as complete\nBEGIN;\n%sCOMMIT;", m.name, baselineRecordPlan(config, m)))
+				continue
+			}
 
-			args := []string{"-d", config["db"], "-f", file}
-			if strings.Contains(filename, createDatabaseMigrationName) {
-				args = []string{"-f", file}
-				log.Printf("Running database creation migration: %s", file)
+			err = recordBaseline(config, m, options)
+			if err != nil {
+				log.Printf("ERROR recording baseline migration:%s\n", err)
+				log.Printf("All further migrations cancelled\n\n")
+				failed = true
+				break
+			}
+			completed = append(completed, m.name)
+			if target != nil && m.name == target.name {
+				break
 			}
+			continue
+		}
 
-			// Execute this sql file against the database
-			result, err := runCommand("psql", args...)
-			if err != nil || strings.Contains(string(result), "ERROR") {
-				if err == nil {
-					err = fmt.Errorf("\n%s", string(result))
+		if m.createsDatabase() {
+			// If the database already exists, there is nothing to create
+			if dbExists {
+				log.Printf("Database exists, recording migration %s as complete", m.name)
+				if options.dryRun {
+					plan = append(plan, fmt.Sprintf("-- Database exists, record migration %s as complete\n%s", m.name, insertMetadataPlan(config, m)))
+				} else {
+					writeMetadata(config, []*migration{m})
 				}
+				continue
+			}
 
+			if options.dryRun {
+				plan = append(plan, migrationPlan(config, m, migrateUp, insertMetadataPlan(config, m), options))
+				dbExists = true
+				continue
+			}
+
+			// Create the database, then record this migration once fragmenta_metadata exists
+			err = createDatabase(config, m, options)
+			if err == nil {
+				err = lockMigrations(config)
+			}
+			if err != nil {
+				log.Printf("ERROR loading sql migration:%s\n", err)
+				log.Printf("All further migrations cancelled\n\n")
+				failed = true
+				break
+			}
+
+			locked = true
+			dbExists = true
+			unrecorded = append(unrecorded, m)
+			completed = append(completed, m.name)
+			log.Printf("Completed migration %s\n%s", m.name, fragmentaDivider)
+			continue
+		}
+
+		if options.dryRun {
+			plan = append(plan, migrationPlan(config, m, migrateUp, insertMetadataPlan(config, m), options))
+		} else {
+			log.Printf("Running migration %s", m.name)
+
+			err = runMigration(config, m, migrateUp, insertMetadataPlan(config, m), options)
+			if err != nil {
 				// If at any point we fail, log it and break
 				log.Printf("ERROR loading sql migration:%s\n", err)
 				log.Printf("All further migrations cancelled\n\n")
+				failed = true
 				break
 			}
 
-			completed = append(completed, filename)
-			log.Printf("Completed migration %s\n%s\n%s", filename, string(result), fragmentaDivider)
+			completed = append(completed, m.name)
+			log.Printf("Completed migration %s\n%s", m.name, fragmentaDivider)
+		}
+
+		if target != nil && m.name == target.name {
+			break
+		}
+	}
+
+	if options.dryRun {
+		writePlan(config, plan, options)
+		return !failed
+	}
+
+	if len(unrecorded) > 0 {
+		writeMetadata(config, unrecorded)
+	}
+
+	// Update the schema dump only if every migration succeeded
+	if options.schema && !failed && len(completed) > 0 {
+		err = writeSchema(config)
+		if err != nil {
+			log.Printf("Error writing schema %s", err)
 		}
 	}
 
 	if len(completed) > 0 {
-		writeMetadata(config, completed)
 		log.Printf("Migrations complete up to migration %s on db %s\n\n", completed[len(completed)-1], config["db"])
 	} else {
 		log.Printf("No migrations to perform at path %s\n\n", "./db/migrate")
 	}
 
+	return !failed
+}
+
+// rollbackDB reverts the last n migrations recorded in fragmenta_metadata, newest first,
+// or if options.to is set, those applied after that version.
+// It returns true if all of them were reverted
+func rollbackDB(config map[string]string, n int, options migrateOptions) bool {
+
+	files, err := readMigrations()
+	if err != nil {
+		log.Printf("Error reading migrations %s", err)
+		return false
+	}
+
+	err = openDatabase(config)
+	if err != nil {
+		log.Printf("Error opening database %s", err)
+		return false
+	}
+	defer query.CloseDatabase()
+
+	if !options.dryRun {
+		err = lockMigrations(config)
+		if err != nil {
+			log.Printf("ERROR locking migrations: %s", err)
+			return false
+		}
+		defer unlockMigrations(config)
+	}
+
+	// Metadata is returned newest first
+	applied, err := readMetadata(config)
+	if err != nil {
+		log.Printf("ERROR reading migrations applied: %s", err)
+		return false
+	}
+
+	if options.to != "" {
+		target, err := matchMigration(options.to, files)
+		if err != nil {
+			log.Printf("Error finding migration %s", err)
+			return false
+		}
+		if !contains(target.name, applied) {
+			log.Printf("Error reverting to %s - migration has not been applied", target.name)
+			return false
+		}
+		return revertMigrations(config, files, appliedAfter(target.name, applied), options)
+	}
+
+	if n > len(applied) {
+		n = len(applied)
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	return revertMigrations(config, files, applied[:n], options)
+}
+
+// revertMigrations runs the down migrations for names in order on the open database,
+// returning true if all of them were reverted
+func revertMigrations(config map[string]string, files []*migration, names []string, options migrateOptions) bool {
+	var plan []string
+
+	if len(names) == 0 {
+		log.Printf("No migrations to revert on db %s\n\n", config["db"])
+		return false
+	}
+
+	for _, name := range names {
+		m := findMigration(name, files)
+		if m == nil {
+			log.Printf("ERROR reverting migration %s - no migration file found", name)
+			return false
+		}
+
+		if !m.canRevert() {
+			log.Printf("ERROR reverting migration %s - no down migration found, add the sql to revert it to %s", name, strings.TrimSuffix(m.path, ".sql")+migrationDownSuffix)
+			return false
+		}
+
+		if m.createsDatabase() {
+			log.Printf("ERROR reverting migration %s - database creation migrations cannot be reverted", name)
+			return false
+		}
+
+		if options.dryRun {
+			plan = append(plan, migrationPlan(config, m, migrateDown, deleteMetadataPlan(m), options))
+			continue
+		}
+
+		log.Printf("Reverting migration %s", name)
+
+		err := runMigration(config, m, migrateDown, deleteMetadataPlan(m), options)
+		if err != nil {
+			log.Printf("ERROR reverting sql migration:%s\n", err)
+			log.Printf("All further migrations cancelled\n\n")
+			return false
+		}
+
+		log.Printf("Reverted migration %s\n%s", name, fragmentaDivider)
+	}
+
+	if options.dryRun {
+		writePlan(config, plan, options)
+		return true
+	}
+
+	if options.schema {
+		err := writeSchema(config)
+		if err != nil {
+			log.Printf("Error writing schema %s", err)
+		}
+	}
+
+	log.Printf("Reverted %d migrations on db %s\n\n", len(names), config["db"])
+	return true
+}
+
+// migrationPlan describes how the sql for this migration would be run,
+// along with the sql to record it in fragmenta_metadata.
+// The plan for migrations other than database creation is also the input for psql.
+func migrationPlan(config map[string]string, m *migration, direction string, record string, options migrateOptions) string {
+	sql := strings.TrimSpace(m.sql(direction))
+
+	if m.goMigration {
+		return fmt.Sprintf("-- Migration %s\n-- Run %s with go run -tags %s on db %s in one transaction with:\n%s", m.name, direction, goMigrationTag, config["db"], record)
+	}
+
+	client := "the query package"
+	if options.psql {
+		client = "psql -v ON_ERROR_STOP=1 -d " + config["db"]
+	}
+
+	if m.createsDatabase() {
+		if options.psql {
+			client = "psql -v ON_ERROR_STOP=1"
+		} else {
+			admin := adminConfig(config)
+			client = fmt.Sprintf("the query package on db %s as user %s", admin["db"], admin["db_user"])
+		}
+		return fmt.Sprintf("-- Migration %s\n-- Run with %s before %s exists, then record once fragmenta_metadata exists\n%s\n%s", m.name, client, config["db"], sql, record)
+	}
+
+	if m.noTransaction {
+		return fmt.Sprintf("-- Migration %s\n-- Run with %s on db %s without a transaction\n%s\n%s", m.name, client, config["db"], sql, record)
+	}
+
+	return fmt.Sprintf("-- Migration %s\n-- Run with %s on db %s in one transaction\nBEGIN;\n%s\n%sCOMMIT;", m.name, client, config["db"], sql, record)
+}
+
+// writePlan prints a dry run plan, and writes it to options.planPath if set
+func writePlan(config map[string]string, plan []string, options migrateOptions) {
+	if len(plan) == 0 {
+		log.Printf("Dry run - no migrations to perform on db %s\n\n", config["db"])
+		return
+	}
+
+	output := fmt.Sprintf("-- Fragmenta %s migration plan for db %s\n\n", fragmentaVersion, config["db"])
+	output += strings.Join(plan, "\n\n") + "\n"
+
+	fmt.Print(output) // fmt to avoid time output
+
+	if options.planPath != "" {
+		err := ioutil.WriteFile(options.planPath, []byte(output), permissions)
+		if err != nil {
+			log.Printf("Error writing plan %s", err)
+			return
+		}
+		log.Printf("Dry run - wrote plan for %d migrations to %s", len(plan), options.planPath)
+	}
+}
+
+// statusDB prints the status of every migration on disk or in fragmenta_metadata,
+// and returns the number of pending migrations (or -1 if migrations could not be read)
+func statusDB(config map[string]string) int {
+
+	files, err := readMigrations()
+	if err != nil {
+		log.Printf("Error reading migrations %s", err)
+		return -1
+	}
+
+	var records []metadata
+	err = openDatabase(config)
+	if err != nil {
+		// if no db, every migration is pending
+		log.Printf("No database found")
+	} else {
+		records, err = readMetadataRecords(config)
+		if err != nil {
+			log.Printf("Error reading migrations applied %s", err)
+			return -1
+		}
+	}
+
+	applied := make(map[string]metadata, len(records))
+	var names []string
+	for _, r := range records {
+		applied[r.migrationVersion] = r
+		names = append(names, r.migrationVersion)
+	}
+
+	pending := pendingMigrations(files, names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "STATUS\tMIGRATION\tUPDATED AT\tFRAGMENTA VERSION\n")
+
+	for _, m := range files {
+		r, ok := applied[m.name]
+		if ok {
+			fmt.Fprintf(w, "applied\t%s\t%s\t%s\n", m.name, formatMetadataTime(r.updatedAt), r.fragmentaVersion)
+		} else {
+			fmt.Fprintf(w, "pending\t%s\t\t\n", m.name)
+		}
+	}
+
+	// Records are newest first, list orphans oldest first to match files
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		if findMigration(r.migrationVersion, files) == nil {
+			fmt.Fprintf(w, "orphaned\t%s\t%s\t%s\n", r.migrationVersion, formatMetadataTime(r.updatedAt), r.fragmentaVersion)
+		}
+	}
+
+	w.Flush()
+	fmt.Printf("\n%d pending migrations on db %s\n", len(pending), config["db"])
+
+	return len(pending)
+}
+
+// pendingMigrations returns the migrations in files which are not in applied
+func pendingMigrations(files []*migration, applied []string) []*migration {
+	var pending []*migration
+	for _, m := range files {
+		if !contains(m.name, applied) {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// verifyDB compares the checksums recorded for applied migrations with the files on disk,
+// prints any which have changed, and returns the number changed (or -1 if verify failed)
+func verifyDB(config map[string]string) int {
+
+	files, err := readMigrations()
+	if err != nil {
+		log.Printf("Error reading migrations %s", err)
+		return -1
+	}
+
+	err = openDatabase(config)
+	if err != nil {
+		log.Printf("Error opening database %s", err)
+		return -1
+	}
+
+	records, err := readMetadataRecords(config)
+	if err != nil {
+		log.Printf("Error reading migrations applied %s", err)
+		return -1
+	}
+
+	drifted := driftedMigrations(files, records)
+	for _, name := range drifted {
+		fmt.Printf("changed\t%s\n", name)
+	}
+
+	fmt.Printf("\n%d migrations changed since they were applied on db %s\n", len(drifted), config["db"])
+	return len(drifted)
+}
+
+// formatMetadataTime formats the time a migration was recorded for display,
+// which drivers return as a time or as text in the format the database stores it
+func formatMetadataTime(t sql.NullString) string {
+	if !t.Valid || t.String == "" {
+		return "-"
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999"} {
+		parsed, err := time.Parse(layout, t.String)
+		if err == nil {
+			return parsed.Format("2006-01-02 15:04:05")
+		}
+	}
+	return t.String
 }
 
 // openDatabase opens the database specified in the config map
 func openDatabase(config map[string]string) error {
+	// Use one connection, so that transactions and session locks
+	// all apply to the same connection
+	query.SetMaxOpenConns(1)
+
 	// Open the database
 	options := map[string]string{
 		"adapter":  config["db_adapter"],
@@ -111,45 +975,183 @@ func openDatabase(config map[string]string) error {
 	return nil
 }
 
-// readMetadata reads the metadata from the fragmenta_metadata table
-func readMetadata() []string {
+// adminConfig returns a copy of config for connecting to the admin database,
+// used to create databases and users. Set db_admin_user, db_admin_pass and db_admin_db
+// in config to change the defaults of the current user and the admin database for the adapter.
+func adminConfig(config map[string]string) map[string]string {
+	admin := make(map[string]string, len(config))
+	for k, v := range config {
+		admin[k] = v
+	}
+
+	admin["db"] = config["db_admin_db"]
+	if admin["db"] == "" {
+		admin["db"] = dialectFor(config).AdminDatabase()
+	}
+
+	admin["db_user"] = config["db_admin_user"]
+	if admin["db_user"] == "" {
+		admin["db_user"] = os.Getenv("USER")
+	}
+
+	admin["db_pass"] = config["db_admin_pass"]
+	return admin
+}
+
+// reopenDatabase closes any open database and opens the database specified in the config map
+func reopenDatabase(config map[string]string) error {
+	query.CloseDatabase()
+	return openDatabase(config)
+}
+
+// readMetadata reads the migration versions from the fragmenta_metadata table, newest first
+func readMetadata(config map[string]string) ([]string, error) {
+	records, err := readMetadataRecords(config)
+	if err != nil {
+		return nil, err
+	}
+
 	var migrations []string
+	for _, r := range records {
+		migrations = append(migrations, r.migrationVersion)
+	}
+
+	return migrations, nil
+}
 
-	sql := "select migration_version from fragmenta_metadata order by id desc;"
+// readMetadataRecords reads the rows from the fragmenta_metadata table, newest first.
+// If the table does not exist there are no records, but any other error is returned,
+// so that callers do not mistake a failed read for a database with no migrations applied.
+func readMetadataRecords(config map[string]string) ([]metadata, error) {
+	var records []metadata
 
-	rows, err := query.QuerySQL(sql)
+	exists, err := tableExists(dialectFor(config), "fragmenta_metadata")
 	if err != nil {
-		log.Printf("Database ERROR %s", err)
-		return migrations
+		return nil, fmt.Errorf("error reading fragmenta_metadata %s", err)
+	}
+	if !exists {
+		return records, nil
+	}
+
+	stmt := "select migration_version,fragmenta_version,updated_at,checksum from fragmenta_metadata order by id desc;"
+
+	rows, err := query.QuerySQL(stmt)
+	if err != nil {
+		// Tables created by older versions have no checksum column
+		stmt = "select migration_version,fragmenta_version,updated_at,'' from fragmenta_metadata order by id desc;"
+		rows, err = query.QuerySQL(stmt)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading fragmenta_metadata %s", err)
 	}
 
-	// We expect just one row, with one column (count)
 	defer rows.Close()
 	for rows.Next() {
-		var migration string
-		err := rows.Scan(&migration)
+		var r metadata
+		var version, sum sql.NullString
+		err := rows.Scan(&r.migrationVersion, &version, &r.updatedAt, &sum)
 		if err != nil {
-			log.Printf("Database ERROR %s", err)
-			return migrations
+			return nil, fmt.Errorf("error reading fragmenta_metadata %s", err)
 		}
-		migrations = append(migrations, migration)
+		r.fragmentaVersion = version.String
+		r.checksum = sum.String
+		records = append(records, r)
+
+	}
 
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error reading fragmenta_metadata %s", err)
 	}
 
-	return migrations
+	return records, nil
+}
+
+// tableExists returns true if the table exists in the open database
+func tableExists(d dialect, table string) (bool, error) {
+	rows, err := query.QuerySQL(d.TableExistsSQL(table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
 }
 
 // writeMetadata writes a new row in the fragmenta_metadata table to record our action
-func writeMetadata(config map[string]string, migrations []string) {
+func writeMetadata(config map[string]string, migrations []*migration) {
 
 	for _, m := range migrations {
-		sql := "Insert into fragmenta_metadata(updated_at,fragmenta_version,migration_version,status) VALUES(NOW(),$1,$2,100);"
-		result, err := query.ExecSQL(sql, fragmentaVersion, m)
+		err := insertMetadata(config, m.name, m.checksum)
+		if err != nil {
+			log.Printf("Database ERROR %s", err)
+		}
+	}
+
+}
+
+// insertMetadata inserts a row in the fragmenta_metadata table recording this migration
+func insertMetadata(config map[string]string, migration string, checksum string) error {
+	// The table may have just been created by this migration without a checksum column
+	err := upgradeMetadata(config)
+	if err != nil {
+		return err
+	}
+
+	d := dialectFor(config)
+	sql := fmt.Sprintf("Insert into fragmenta_metadata(updated_at,fragmenta_version,migration_version,status,checksum) VALUES(CURRENT_TIMESTAMP,%s,%s,100,%s);", d.Placeholder(1), d.Placeholder(2), d.Placeholder(3))
+	_, err = query.ExecSQL(sql, fragmentaVersion, migration, checksum)
+	return err
+}
+
+// metadataTableSQL returns sql to create the fragmenta_metadata table if it does not exist
+func metadataTableSQL(config map[string]string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS fragmenta_metadata (%s, updated_at timestamp, fragmenta_version text, migration_version text, status integer, checksum text);\n", dialectFor(config).PrimaryKeySQL())
+}
+
+// insertMetadataPlan returns the sql to record this migration in fragmenta_metadata,
+// making sure first that the table has a checksum column if the database can do so in sql
+func insertMetadataPlan(config map[string]string, m *migration) string {
+	sql := dialectFor(config).AddColumnSQL("fragmenta_metadata", "checksum", "text")
+	sql += fmt.Sprintf("Insert into fragmenta_metadata(updated_at,fragmenta_version,migration_version,status,checksum) VALUES(CURRENT_TIMESTAMP,%s,%s,100,%s);\n", quoteSQL(fragmentaVersion), quoteSQL(m.name), quoteSQL(m.checksum))
+	return sql
+}
+
+// deleteMetadataPlan returns the sql to remove the record of this migration from fragmenta_metadata
+func deleteMetadataPlan(m *migration) string {
+	return fmt.Sprintf("DELETE FROM fragmenta_metadata WHERE migration_version=%s;\n", quoteSQL(m.name))
+}
+
+// quoteSQL quotes a string as an sql literal
+func quoteSQL(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// upgradeMetadata adds columns to fragmenta_metadata tables created by older versions
+func upgradeMetadata(config map[string]string) error {
+	for _, sql := range upgradeMetadataSQL(config) {
+		_, err := query.ExecSQL(sql)
 		if err != nil {
-			log.Printf("Database ERROR %s %s", err, result)
+			return err
 		}
 	}
+	return nil
+}
+
+// upgradeMetadataSQL returns the sql required to add columns missing from fragmenta_metadata
+func upgradeMetadataSQL(config map[string]string) []string {
+	sql := dialectFor(config).AddColumnSQL("fragmenta_metadata", "checksum", "text")
+	if sql != "" {
+		return []string{sql}
+	}
 
+	// Otherwise check for the column first, this is safe within
+	// a transaction as mysql and sqlite do not abort on errors
+	rows, err := query.QuerySQL("SELECT checksum FROM fragmenta_metadata WHERE 1=0;")
+	if err == nil {
+		rows.Close()
+		return nil
+	}
+	return []string{"ALTER TABLE fragmenta_metadata ADD COLUMN checksum text;"}
 }
 
 // contains checks whether an array of strings contains a string
@@ -161,3 +1163,13 @@ func contains(s string, a []string) bool {
 	}
 	return false
 }
+
+// containsAny returns true if any of the strings in s are in a
+func containsAny(s []string, a []string) bool {
+	for _, k := range s {
+		if contains(k, a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// TestParseMigration tests splitting migrations into up and down sql
+func TestParseMigration(t *testing.T) {
+	sql := "CREATE TABLE pages (id int);\n-- +down\nDROP TABLE pages;\n"
+	m := parseMigration("2016-01-01-120000-Create-Pages.sql", sql)
+	if m.up != "CREATE TABLE pages (id int);" {
+		t.Fatalf("Failed to parse up migration result:'%s'", m.up)
+	}
+	if m.down != "DROP TABLE pages;\n" {
+		t.Fatalf("Failed to parse down migration result:'%s'", m.down)
+	}
+
+	sql = "CREATE TABLE pages (id int);\n"
+	m = parseMigration("2016-01-01-120000-Create-Pages.sql", sql)
+	if m.up != sql || m.down != "" {
+		t.Fatalf("Failed to parse up only migration up:'%s' down:'%s'", m.up, m.down)
+	}
+
+	if m.noTransaction {
+		t.Fatalf("Failed to parse migration, transaction disabled without marker")
+	}
+
+	sql = "-- +notransaction\nCREATE INDEX CONCURRENTLY pages_name ON pages (name);\n"
+	m = parseMigration("2016-01-01-120000-Index-Pages.sql", sql)
+	if !m.noTransaction {
+		t.Fatalf("Failed to parse migration, transaction not disabled by marker")
+	}
+
+	// Down migrations generated with only a placeholder comment cannot be run
+	m = parseMigration("2016-01-01-120000-Update-Pages.sql", "UPDATE pages SET status=100;\n-- +down\n/* SQL to revert migration Update-Pages */\n")
+	if m.canRevert() {
+		t.Fatalf("Failed to refuse placeholder down migration")
+	}
+	m.down = "/* SQL to revert migration Update-Pages */\nUPDATE pages SET status=0;\n"
+	if !m.canRevert() {
+		t.Fatalf("Failed to accept down migration")
+	}
+
+	m = parseMigration("2016-01-01-120000-Create-Database.sql", "CREATE DATABASE x;")
+	if !m.noTransaction {
+		t.Fatalf("Failed to parse migration, transaction not disabled for database creation")
+	}
+}
+
+// TestDriftedMigrations tests detecting migrations edited after they were applied
+func TestDriftedMigrations(t *testing.T) {
+	migrations := []*migration{
+		{name: "a.sql", checksum: checksum([]byte("a"))},
+		{name: "b.sql", checksum: checksum([]byte("b edited"))},
+		{name: "c.sql", checksum: checksum([]byte("c"))},
+	}
+	records := []metadata{
+		{migrationVersion: "c.sql", checksum: ""},
+		{migrationVersion: "b.sql", checksum: checksum([]byte("b"))},
+		{migrationVersion: "a.sql", checksum: checksum([]byte("a"))},
+		{migrationVersion: "orphan.sql", checksum: checksum([]byte("orphan"))},
+	}
+
+	drifted := driftedMigrations(migrations, records)
+	if len(drifted) != 1 || drifted[0] != "b.sql" {
+		t.Fatalf("Failed to find drifted migrations result:%v", drifted)
+	}
+}
+
+// TestPendingMigrations tests finding migrations which have not been applied
+func TestPendingMigrations(t *testing.T) {
+	files := []*migration{{name: "a.sql"}, {name: "b.go"}, {name: "c.sql"}}
+
+	pending := pendingMigrations(files, []string{"c.sql", "a.sql", "orphan.sql"})
+	if len(pending) != 1 || pending[0].name != "b.go" {
+		t.Fatalf("Failed to find pending migrations result:%v", pending)
+	}
+
+	if len(pendingMigrations(files, nil)) != 3 {
+		t.Fatalf("Failed to find pending migrations on a new database")
+	}
+}
+
+// TestFormatMetadataTime tests displaying the times drivers return for updated_at
+func TestFormatMetadataTime(t *testing.T) {
+	tests := []struct {
+		value    sql.NullString
+		expected string
+	}{
+		{sql.NullString{}, "-"},
+		{sql.NullString{String: "2016-01-02T15:04:05.123456Z", Valid: true}, "2016-01-02 15:04:05"},
+		{sql.NullString{String: "2016-01-02 15:04:05+00:00", Valid: true}, "2016-01-02 15:04:05"},
+		{sql.NullString{String: "2016-01-02 15:04:05", Valid: true}, "2016-01-02 15:04:05"},
+		{sql.NullString{String: "yesterday", Valid: true}, "yesterday"},
+	}
+
+	for _, test := range tests {
+		result := formatMetadataTime(test.value)
+		if result != test.expected {
+			t.Fatalf("Failed to format time %q expected:%s result:%s", test.value.String, test.expected, result)
+		}
+	}
+}
+
+// TestMatchMigration tests finding migrations by version prefix
+func TestMatchMigration(t *testing.T) {
+	migrations := []*migration{
+		{name: "2016-01-01-120000-Create-Database.sql"},
+		{name: "2016-01-02-150405-Create-Pages.sql"},
+		{name: "2016-01-02-160000-Create-Users.sql"},
+	}
+
+	m, err := matchMigration("2016-01-02-150405", migrations)
+	if err != nil || m.name != "2016-01-02-150405-Create-Pages.sql" {
+		t.Fatalf("Failed to match migration by prefix result:%v %v", m, err)
+	}
+
+	m, err = matchMigration("2016-01-02-160000-Create-Users", migrations)
+	if err != nil || m.name != "2016-01-02-160000-Create-Users.sql" {
+		t.Fatalf("Failed to match migration by name result:%v %v", m, err)
+	}
+
+	_, err = matchMigration("2016-01-02", migrations)
+	if err == nil {
+		t.Fatalf("Failed to reject ambiguous migration prefix")
+	}
+
+	_, err = matchMigration("2017", migrations)
+	if err == nil {
+		t.Fatalf("Failed to reject unknown migration")
+	}
+
+	after := appliedAfter("2016-01-01-120000-Create-Database.sql", []string{"2016-01-02-160000-Create-Users.sql", "2016-01-01-120000-Create-Database.sql"})
+	if len(after) != 1 || after[0] != "2016-01-02-160000-Create-Users.sql" {
+		t.Fatalf("Failed to find migrations applied after version result:%v", after)
+	}
+}
+
+// TestMigrationPlan tests describing migrations for a dry run
+func TestMigrationPlan(t *testing.T) {
+	config := map[string]string{"db": "app_development"}
+
+	m := parseMigration("2016-01-02-150405-Create-Pages.sql", "CREATE TABLE pages (id int);\n")
+	plan := migrationPlan(config, m, migrateUp, insertMetadataPlan(config, m), migrateOptions{})
+	if !strings.Contains(plan, "BEGIN;\nCREATE TABLE pages (id int);\nALTER TABLE fragmenta_metadata") || !strings.HasSuffix(plan, "COMMIT;") {
+		t.Fatalf("Failed to plan migration in transaction result:\n%s", plan)
+	}
+
+	m = parseMigration("2016-01-01-120000-Create-Database.sql", "CREATE DATABASE app_development;\n")
+	plan = migrationPlan(config, m, migrateUp, insertMetadataPlan(config, m), migrateOptions{psql: true})
+	if strings.Contains(plan, "BEGIN;") || !strings.Contains(plan, "psql") {
+		t.Fatalf("Failed to plan database creation migration result:\n%s", plan)
+	}
+
+	m = &migration{name: "2016-01-03-120000-Backfill-Slugs.go", goMigration: true}
+	plan = migrationPlan(config, m, migrateDown, deleteMetadataPlan(m), migrateOptions{})
+	if !strings.Contains(plan, "Run down with go run") || !strings.Contains(plan, "DELETE FROM fragmenta_metadata") || !m.canRevert() {
+		t.Fatalf("Failed to plan go migration result:\n%s", plan)
+	}
+
+	if quoteSQL("it's") != "'it''s'" {
+		t.Fatalf("Failed to quote sql result:%s", quoteSQL("it's"))
+	}
+}
@@ -19,11 +19,16 @@ const (
 )
 
 // RunNew creates a new fragmenta project given the argument
-// Usage: fragmenta new [app|cms|api| valid repo path e.g. github.com/fragmenta/fragmenta-cms]
+// Usage: fragmenta new [app|cms|api| valid repo path e.g. github.com/fragmenta/fragmenta-cms] [--adapter postgres|mysql|sqlite3]
 func RunNew(args []string) {
 
-	// Remove fragmenta backup from args list
-	args = args[2:]
+	// Remove fragmenta new from args list
+	args, flags := parseArgs(args[2:])
+
+	adapter := flags["adapter"]
+	if adapter == "" {
+		adapter = AdapterPostgres
+	}
 
 	// We expect two args left:
 	if len(args) < 2 {
@@ -78,7 +83,7 @@ func RunNew(args []string) {
 	}
 
 	// Generate config files
-	err = generateConfig(projectPath)
+	err = generateConfig(projectPath, adapter)
 	if err != nil {
 		log.Printf("Error generating config %s", err)
 		return
@@ -248,18 +253,22 @@ func showNewSiteHelp(projectPath string) {
 // generateCreateSQL generates an SQL migration file to create the database user and database referred to in config
 func generateCreateSQL(projectPath string) error {
 
-	// Set up a Create-Database migration, which comes first
+	// Set up a Create-Database migration, which comes first, if the database requires one
 	name := filepath.Base(projectPath)
 	d := ConfigDevelopment["db"]
 	u := ConfigDevelopment["db_user"]
 	p := ConfigDevelopment["db_pass"]
-	sql := fmt.Sprintf("/* Setup database for %s */\nCREATE USER \"%s\" WITH PASSWORD '%s';\nCREATE DATABASE \"%s\" WITH OWNER \"%s\";", name, u, p, d, u)
-
-	// Generate a migration to create db with today's date
-	file := migrationPath(projectPath, createDatabaseMigrationName)
-	err := ioutil.WriteFile(file, []byte(sql), 0744)
-	if err != nil {
-		return err
+	dialect := dialectFor(ConfigDevelopment)
+	createSQL := dialect.CreateDatabaseSQL(d, u)
+	if createSQL != "" {
+		sql := fmt.Sprintf("/* Setup database for %s */\n%s\n%s", name, dialect.CreateUserSQL(u, p), createSQL)
+
+		// Generate a migration to create db with today's date
+		file := migrationPath(projectPath, createDatabaseMigrationName)
+		err := ioutil.WriteFile(file, []byte(sql), 0744)
+		if err != nil {
+			return err
+		}
 	}
 
 	// If we have a Create-Tables file, copy it out to a new migration with today's date
@@ -273,7 +282,7 @@ func generateCreateSQL(projectPath string) error {
 		// Now vivify the template, for now we just replace one key
 		sqlString := reifyString(string(sql))
 
-		file = migrationPath(projectPath, createTablesMigrationName)
+		file := migrationPath(projectPath, createTablesMigrationName)
 		err = ioutil.WriteFile(file, []byte(sqlString), 0744)
 		if err != nil {
 			return err
@@ -288,7 +297,8 @@ func generateCreateSQL(projectPath string) error {
 	return nil
 }
 
-func generateConfig(projectPath string) error {
+// generateConfig generates the config file for the new project, using the database adapter given
+func generateConfig(projectPath string, adapter string) error {
 	configPath := configPath(projectPath)
 	prefix := filepath.Base(projectPath)
 	log.Printf("Generating new config at %s", configPath)
@@ -298,7 +308,7 @@ func generateConfig(projectPath string) error {
 	ConfigTest = map[string]string{
 		"port":            "3000",
 		"log":             "log/test.log",
-		"db_adapter":      "postgres",
+		"db_adapter":      adapter,
 		"db":              prefix + "_test",
 		"db_user":         prefix + "_server",
 		"db_pass":         randomKey(8),
@@ -327,6 +337,13 @@ func generateConfig(projectPath string) error {
 	ConfigProduction["hmac_key"] = randomKey(32)
 	ConfigProduction["secret_key"] = randomKey(32)
 
+	// Sqlite databases are files within the project
+	if dialectFor(ConfigTest).Name() == AdapterSqlite {
+		ConfigTest["db"] = filepath.Join("db", prefix+"_test.sqlite")
+		ConfigDevelopment["db"] = filepath.Join("db", prefix+"_development.sqlite")
+		ConfigProduction["db"] = filepath.Join("db", prefix+"_production.sqlite")
+	}
+
 	configs := map[string]map[string]string{
 		ModeProduction:  ConfigProduction,
 		ModeDevelopment: ConfigDevelopment,
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// The suffix added to the database in the names of backups of some tables
+const partialSuffix = "-partial"
+
+// parseTables returns the table names in a comma separated list such as users,pages
+func parseTables(list string) ([]string, error) {
+	var tables []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !validIdentifier.MatchString(t) {
+			return nil, fmt.Errorf("invalid table name %q", t)
+		}
+		tables = append(tables, t)
+	}
+
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables given")
+	}
+	return tables, nil
+}
+
+// isPartial returns true if the backup contains only some tables
+func (b backupFile) isPartial() bool {
+	return strings.Contains(b.db, partialSuffix)
+}
+
+// Statements in sql dumps which are used when extracting tables
+var (
+	tablesCreate   = regexp.MustCompile(`^CREATE TABLE (?:IF NOT EXISTS )?([^ (]+)`)
+	tablesCopy     = regexp.MustCompile(`^COPY ([^ ]+) `)
+	tablesInsert   = regexp.MustCompile(`^INSERT INTO ([^ (]+)`)
+	tablesOwned    = regexp.MustCompile(`^ALTER SEQUENCE ([^ ]+) OWNED BY ([^ ;]+)`)
+	tablesSequence = regexp.MustCompile(`^SELECT pg_catalog\.setval\('([^']+)'`)
+)
+
+// extractTables copies the data for tables from the sql dump read from in to out, as a script which
+// replaces the rows in those tables in one transaction, leaving the schema and other tables alone.
+// Rows are deleted in the reverse of the order given and loaded in the order given, so tables
+// should be listed with those referred to by foreign keys first. Foreign key checks are turned off
+// while the rows are replaced, so that deletes do not cascade to other tables. If any of the tables
+// is not in the dump, an error is returned before the transaction is committed.
+func extractTables(in io.Reader, out io.Writer, adapter string, tables []string) error {
+	r := bufio.NewReaderSize(in, 64*1024)
+	w := bufio.NewWriter(out)
+
+	switch adapter {
+	case AdapterPostgres:
+		// psql should stop at the first error, rather than continuing without the transaction
+		fmt.Fprintf(w, "\\set ON_ERROR_STOP on\n")
+	case AdapterMysql:
+		fmt.Fprintf(w, "SET FOREIGN_KEY_CHECKS=0;\n")
+	case AdapterSqlite:
+		fmt.Fprintf(w, "PRAGMA foreign_keys=OFF;\n")
+	}
+
+	fmt.Fprintf(w, "BEGIN;\n")
+	if adapter == AdapterPostgres {
+		// Disable foreign key triggers, so that deletes do not cascade to other tables
+		fmt.Fprintf(w, "SET LOCAL session_replication_role = replica;\n")
+	}
+	for i := len(tables) - 1; i >= 0; i-- {
+		fmt.Fprintf(w, "DELETE FROM %s;\n", tables[i])
+	}
+
+	found := make(map[string]bool)
+	sequences := make(map[string]string)
+	copying, keep := false, false
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" {
+			break
+		}
+
+		text := strings.TrimSuffix(line, "\n")
+		emit := false
+		if copying {
+			emit = keep
+			copying = text != `\.`
+		} else if match := tablesCopy.FindStringSubmatch(text); match != nil {
+			copying = true
+			keep = contains(unquoteIdentifier(match[1]), tables)
+			emit = keep
+		} else if match := tablesInsert.FindStringSubmatch(text); match != nil {
+			emit = contains(unquoteIdentifier(match[1]), tables)
+		} else if match := tablesCreate.FindStringSubmatch(text); match != nil {
+			found[unquoteIdentifier(match[1])] = true
+		} else if match := tablesOwned.FindStringSubmatch(text); match != nil {
+			// The owner is table.column, possibly with a schema
+			owner := strings.Split(match[2], ".")
+			if len(owner) > 1 {
+				sequences[unquoteIdentifier(match[1])] = strings.Trim(owner[len(owner)-2], `"`)
+			}
+		} else if match := tablesSequence.FindStringSubmatch(text); match != nil {
+			emit = contains(sequences[unquoteIdentifier(match[1])], tables)
+		} else {
+			// Keep session settings such as the client encoding
+			emit = strings.HasPrefix(text, "SET ") || strings.HasPrefix(text, "SELECT pg_catalog.set_config(") ||
+				(strings.HasPrefix(text, "/*!") && strings.Contains(text, " SET "))
+		}
+
+		if emit {
+			_, werr := w.WriteString(line)
+			if werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	for _, t := range tables {
+		if !found[t] {
+			return fmt.Errorf("table %s not found in backup", t)
+		}
+	}
+
+	fmt.Fprintf(w, "COMMIT;\n")
+	return w.Flush()
+}
+
+// newTablesReader returns a reader of the script to restore tables from the sql dump read from r
+func newTablesReader(r io.Reader, adapter string, tables []string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(extractTables(r, pw, adapter, tables))
+	}()
+	return pr
+}
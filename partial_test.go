@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testPostgresDump is an abbreviated pg_dump -c backup
+const testPostgresDump = `SET client_encoding = 'UTF8';
+SELECT pg_catalog.set_config('search_path', '', false);
+DROP TABLE public.users;
+DROP TABLE public.pages;
+CREATE TABLE public.pages (
+    id integer NOT NULL,
+    name text
+);
+CREATE SEQUENCE public.pages_id_seq;
+ALTER SEQUENCE public.pages_id_seq OWNED BY public.pages.id;
+CREATE TABLE public.users (
+    id integer NOT NULL
+);
+CREATE SEQUENCE public.users_id_seq;
+ALTER SEQUENCE public.users_id_seq OWNED BY public.users.id;
+COPY public.pages (id, name) FROM stdin;
+1	Home
+2	About
+\.
+COPY public.users (id) FROM stdin;
+1
+\.
+SELECT pg_catalog.setval('public.pages_id_seq', 2, true);
+SELECT pg_catalog.setval('public.users_id_seq', 1, true);
+`
+
+// testMysqlDump is an abbreviated mysqldump --complete-insert backup
+const testMysqlDump = "/*!40101 SET NAMES utf8mb4 */;\n" +
+	"DROP TABLE IF EXISTS `pages`;\n" +
+	"CREATE TABLE `pages` (\n  `id` int NOT NULL\n);\n" +
+	"LOCK TABLES `pages` WRITE;\n" +
+	"INSERT INTO `pages` (`id`) VALUES (1),(2);\n" +
+	"UNLOCK TABLES;\n" +
+	"CREATE TABLE `users` (\n  `id` int NOT NULL\n);\n" +
+	"INSERT INTO `users` (`id`) VALUES (1);\n"
+
+// TestExtractTables tests extracting the rows of some tables from full backups
+func TestExtractTables(t *testing.T) {
+	tests := []struct {
+		adapter  string
+		dump     string
+		expected string
+	}{
+		{
+			AdapterPostgres,
+			testPostgresDump,
+			"\\set ON_ERROR_STOP on\nBEGIN;\nSET LOCAL session_replication_role = replica;\nDELETE FROM pages;\nSET client_encoding = 'UTF8';\nSELECT pg_catalog.set_config('search_path', '', false);\nCOPY public.pages (id, name) FROM stdin;\n1\tHome\n2\tAbout\n\\.\nSELECT pg_catalog.setval('public.pages_id_seq', 2, true);\nCOMMIT;\n",
+		},
+		{
+			AdapterMysql,
+			testMysqlDump,
+			"SET FOREIGN_KEY_CHECKS=0;\nBEGIN;\nDELETE FROM pages;\n/*!40101 SET NAMES utf8mb4 */;\nINSERT INTO `pages` (`id`) VALUES (1),(2);\nCOMMIT;\n",
+		},
+		{
+			AdapterSqlite,
+			"PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\nCREATE TABLE pages (id integer);\nINSERT INTO \"pages\" (\"id\") VALUES (1);\nCREATE TABLE \"users\" (id integer);\nINSERT INTO \"users\" (\"id\") VALUES (1);\nCOMMIT;\n",
+			"PRAGMA foreign_keys=OFF;\nBEGIN;\nDELETE FROM pages;\nINSERT INTO \"pages\" (\"id\") VALUES (1);\nCOMMIT;\n",
+		},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := extractTables(strings.NewReader(test.dump), &out, test.adapter, []string{"pages"})
+		if err != nil || out.String() != test.expected {
+			t.Fatalf("Failed to extract tables for %s %s\nexpected:\n%s\nresult:\n%s", test.adapter, err, test.expected, out.String())
+		}
+	}
+
+	// Tables are deleted in reverse order, then loaded in order
+	var out bytes.Buffer
+	err := extractTables(strings.NewReader(testPostgresDump), &out, AdapterPostgres, []string{"users", "pages"})
+	if err != nil || !strings.Contains(out.String(), "DELETE FROM pages;\nDELETE FROM users;\n") || !strings.Contains(out.String(), "setval('public.users_id_seq'") {
+		t.Fatalf("Failed to extract two tables %s\n%s", err, out.String())
+	}
+
+	// Text with line breaks in sqlite dumps is kept on one line
+	insert := "INSERT INTO \"pages\" (\"id\",\"body\") VALUES (1," + sqlLiteral("line one\nline two\r\n") + ");\n"
+	out.Reset()
+	err = extractTables(strings.NewReader("CREATE TABLE pages (id integer, body text);\n"+insert), &out, AdapterSqlite, []string{"pages"})
+	if err != nil || !strings.HasSuffix(out.String(), insert+"COMMIT;\n") {
+		t.Fatalf("Failed to extract multi-line text %s\n%s", err, out.String())
+	}
+
+	literal := sqlLiteral("it's\nline two")
+	value, ok := unquoteText(literal)
+	if literal != "'it''s'||char(10)||'line two'" || !ok || value != "it's\nline two" {
+		t.Fatalf("Failed to quote multi-line text literal:%s value:%q", literal, value)
+	}
+
+	// Missing tables should fail without committing
+	out.Reset()
+	err = extractTables(strings.NewReader(testMysqlDump), &out, AdapterMysql, []string{"comments"})
+	if err == nil || strings.Contains(out.String(), "COMMIT") {
+		t.Fatalf("Failed to reject missing table")
+	}
+}
+
+// TestParseTables tests parsing lists of tables
+func TestParseTables(t *testing.T) {
+	tables, err := parseTables("users, pages,")
+	if err != nil || strings.Join(tables, ",") != "users,pages" {
+		t.Fatalf("Failed to parse tables %v %s", tables, err)
+	}
+
+	for _, list := range []string{"", "users;drop table pages", "pages,a b"} {
+		_, err = parseTables(list)
+		if err == nil {
+			t.Fatalf("Failed to reject tables %q", list)
+		}
+	}
+
+	if !(backupFile{db: "app-partial"}).isPartial() || (backupFile{db: "app"}).isPartial() {
+		t.Fatalf("Failed to detect partial backups")
+	}
+}
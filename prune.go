@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The layout of the time at the start of backup file names
+const backupTimeLayout = "2006-01-02-15-04"
+
+// backupFile is one backup archive in a backup store
+type backupFile struct {
+	// The name of the archive in its store, for local stores this is its path
+	path string
+	// The time the backup was made, from the file name
+	time time.Time
+	// The database backed up, from the file name (empty for older backups)
+	db string
+	// The size of the archive in bytes
+	size int64
+}
+
+// retention is the backup retention policy set in config by
+// backup_keep_last, backup_keep_daily and backup_keep_weekly
+type retention struct {
+	// Keep the last n backups
+	last int
+	// Keep the newest backup on each of the last n days
+	daily int
+	// Keep the newest backup in each of the last n weeks
+	weekly int
+}
+
+// retentionPolicy reads the retention policy from config, any settings missing are 0
+func retentionPolicy(config map[string]string) (retention, error) {
+	var policy retention
+	settings := map[string]*int{
+		"backup_keep_last":   &policy.last,
+		"backup_keep_daily":  &policy.daily,
+		"backup_keep_weekly": &policy.weekly,
+	}
+
+	for key, value := range settings {
+		if config[key] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(config[key])
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid %s %q", key, config[key])
+		}
+		*value = n
+	}
+
+	return policy, nil
+}
+
+// isSet returns true if any retention settings are set
+func (r retention) isSet() bool {
+	return r.last > 0 || r.daily > 0 || r.weekly > 0
+}
+
+// readBackups returns the backups in store, newest first,
+// skipping any files whose names do not start with a time
+func readBackups(store backupStore) ([]backupFile, error) {
+	files, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupFile
+	for _, file := range files {
+		name := filepath.Base(file.name)
+		if !strings.HasSuffix(name, ".sql.gz") && !strings.HasSuffix(name, ".sql.gz"+encryptedExtension) {
+			continue
+		}
+		if len(name) < len(backupTimeLayout) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeLayout, name[:len(backupTimeLayout)], time.Local)
+		if err != nil {
+			continue
+		}
+		db := strings.TrimSuffix(name[len(backupTimeLayout):], encryptedExtension)
+		db = strings.TrimPrefix(strings.TrimSuffix(db, ".sql.gz"), "-")
+		backups = append(backups, backupFile{path: file.name, time: t, db: db, size: file.size})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+
+	return backups, nil
+}
+
+// retainedBackups returns the paths of backups (sorted newest first) kept by the policy at time now.
+// The newest policy.last backups are kept, along with the newest backup on each of the
+// last policy.daily days, and the newest backup in each of the last policy.weekly weeks.
+func retainedBackups(backups []backupFile, policy retention, now time.Time) map[string]bool {
+	kept := make(map[string]bool)
+
+	for i, b := range backups {
+		if i < policy.last {
+			kept[b.path] = true
+		}
+	}
+
+	days := make(map[string]bool)
+	dailyFrom := now.AddDate(0, 0, -policy.daily)
+	weeks := make(map[string]bool)
+	weeklyFrom := now.AddDate(0, 0, -7*policy.weekly)
+
+	for _, b := range backups {
+		day := b.time.Format("2006-01-02")
+		if b.time.After(dailyFrom) && !days[day] {
+			days[day] = true
+			kept[b.path] = true
+		}
+
+		year, w := b.time.ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, w)
+		if b.time.After(weeklyFrom) && !weeks[week] {
+			weeks[week] = true
+			kept[b.path] = true
+		}
+	}
+
+	return kept
+}
+
+// prunedBackups returns the backups of the database named db in all (sorted newest first),
+// and those of them kept by policy at time now. Sanitized backups are kept by the policy
+// on their own, so that they do not push out the backups used to restore.
+func prunedBackups(all []backupFile, db string, policy retention, now time.Time) ([]backupFile, map[string]bool) {
+	kept := make(map[string]bool)
+
+	var backups []backupFile
+	for _, name := range []string{db, db + sanitizedSuffix} {
+		var matched []backupFile
+		for _, b := range all {
+			if b.db == name {
+				matched = append(matched, b)
+			}
+		}
+
+		for path := range retainedBackups(matched, policy, now) {
+			kept[path] = true
+		}
+		backups = append(backups, matched...)
+	}
+
+	return backups, kept
+}
+
+// pruneBackups deletes the backups of the database in config not kept by the retention policy in config,
+// or if dryRun is true lists them. If no policy is set, all backups are kept. Sanitized backups of the
+// database are pruned with the same policy, separately from the other backups.
+// Backups of other databases, partial backups, and older backups without a database in the name, are left alone.
+// It returns false if pruning failed.
+func pruneBackups(config map[string]string, dryRun bool) bool {
+	policy, err := retentionPolicy(config)
+	if err != nil {
+		log.Printf("Error reading backup retention %s", err)
+		return false
+	}
+
+	if !policy.isSet() {
+		log.Printf("No backup retention set, keeping all backups")
+		return true
+	}
+
+	store, err := backupStoreFor(config)
+	if err != nil {
+		log.Printf("Error reading backups %s", err)
+		return false
+	}
+
+	all, err := readBackups(store)
+	if err != nil {
+		log.Printf("Error reading backups %s", err)
+		return false
+	}
+
+	backups, kept := prunedBackups(all, backupName(config), policy, time.Now())
+
+	pruned := 0
+	for _, b := range backups {
+		if kept[b.path] {
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("prune\t%s\n", b.path)
+			pruned++
+			continue
+		}
+
+		err = store.Delete(b.path)
+		if err != nil {
+			log.Printf("Error pruning backup %s", err)
+			return false
+		}
+		store.Delete(manifestPath(b.path))
+		pruned++
+	}
+
+	if dryRun {
+		log.Printf("Dry run - would prune %d backups and keep %d", pruned, len(kept))
+	} else {
+		log.Printf("Pruned %d backups, kept %d", pruned, len(kept))
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRetainedBackups tests choosing backups to keep with a retention policy
+func TestRetainedBackups(t *testing.T) {
+	now := time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC) // a Thursday
+
+	var backups []backupFile
+	for _, name := range []string{
+		"2016-03-10-09-00", "2016-03-10-06-00", "2016-03-09-22-00", "2016-03-09-10-00",
+		"2016-03-08-10-00", "2016-03-03-10-00", "2016-02-25-10-00", "2016-01-01-10-00",
+	} {
+		bt, _ := time.Parse(backupTimeLayout, name)
+		backups = append(backups, backupFile{path: name + ".sql.gz", time: bt})
+	}
+
+	kept := retainedBackups(backups, retention{last: 1, daily: 2, weekly: 3}, now)
+
+	var names []string
+	for path := range kept {
+		names = append(names, strings.TrimSuffix(path, ".sql.gz"))
+	}
+	sort.Strings(names)
+
+	// The last, then the newest on each of the last 2 days, then in each of the last 3 weeks
+	expected := "2016-02-25-10-00,2016-03-03-10-00,2016-03-09-22-00,2016-03-10-09-00"
+	if strings.Join(names, ",") != expected {
+		t.Fatalf("Failed to keep backups result:%v", names)
+	}
+
+	if len(retainedBackups(backups, retention{}, now)) != 0 {
+		t.Fatalf("Failed to keep no backups without a policy")
+	}
+}
+
+// TestPrunedBackups tests pruning sanitized backups separately with the same policy
+func TestPrunedBackups(t *testing.T) {
+	now := time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	var all []backupFile
+	for _, name := range []string{
+		"2016-03-10-09-00-app-sanitized", "2016-03-10-08-00-app", "2016-03-09-09-00-app-sanitized",
+		"2016-03-09-08-00-app", "2016-03-08-08-00-app-partial", "2016-03-08-07-00-other",
+	} {
+		bt, _ := time.Parse(backupTimeLayout, name[:len(backupTimeLayout)])
+		all = append(all, backupFile{path: name + ".sql.gz", time: bt, db: name[len(backupTimeLayout)+1:]})
+	}
+
+	backups, kept := prunedBackups(all, "app", retention{last: 1}, now)
+
+	var names []string
+	for _, b := range backups {
+		if !kept[b.path] {
+			names = append(names, strings.TrimSuffix(b.path, ".sql.gz"))
+		}
+	}
+
+	expected := "2016-03-09-08-00-app,2016-03-09-09-00-app-sanitized"
+	if len(backups) != 4 || strings.Join(names, ",") != expected {
+		t.Fatalf("Failed to prune backups expected:%s result:%v of %d", expected, names, len(backups))
+	}
+}
+
+// TestRetentionPolicy tests reading retention settings from config
+func TestRetentionPolicy(t *testing.T) {
+	policy, err := retentionPolicy(map[string]string{"backup_keep_last": "5", "backup_keep_weekly": "4"})
+	if err != nil || policy.last != 5 || policy.daily != 0 || policy.weekly != 4 || !policy.isSet() {
+		t.Fatalf("Failed to read retention policy result:%v %s", policy, err)
+	}
+
+	_, err = retentionPolicy(map[string]string{"backup_keep_daily": "a week"})
+	if err == nil {
+		t.Fatalf("Failed to reject invalid retention setting")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The hash of an empty request body, used to sign requests without a body
+const s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Store keeps backups in a bucket on Amazon S3 or an S3 compatible service such as MinIO,
+// using path style urls and requests signed with AWS Signature Version 4
+type s3Store struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3Store returns a store for the bucket set in config by backup_s3_bucket, backup_s3_prefix,
+// backup_s3_region, backup_s3_endpoint, backup_s3_access_key and backup_s3_secret_key
+func newS3Store(config map[string]string) (*s3Store, error) {
+	s := &s3Store{
+		endpoint:  strings.TrimSuffix(config["backup_s3_endpoint"], "/"),
+		bucket:    config["backup_s3_bucket"],
+		prefix:    strings.Trim(config["backup_s3_prefix"], "/"),
+		region:    config["backup_s3_region"],
+		accessKey: config["backup_s3_access_key"],
+		secretKey: config["backup_s3_secret_key"],
+		client:    &http.Client{},
+	}
+
+	if s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("backup_s3_bucket, backup_s3_access_key and backup_s3_secret_key must be set for the s3 backup store")
+	}
+
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	if s.endpoint == "" {
+		s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+
+	return s, nil
+}
+
+// s3ListResult is the response to a ListObjectsV2 request
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the files in the bucket under the prefix, named without the prefix
+func (s *s3Store) List() ([]storedFile, error) {
+	var files []storedFile
+
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do("GET", "", query, nil, s3EmptyHash, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading bucket list %s", err)
+		}
+
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, s.prefix)
+			// Skip files in folders within the prefix
+			if strings.Contains(name, "/") {
+				continue
+			}
+			files = append(files, storedFile{name: name, size: c.Size})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Put uploads the file at path to the bucket
+func (s *s3Store) Put(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The hash of the body is signed, so that S3 rejects the upload if it is corrupted
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do("PUT", filepath.Base(path), nil, f, hex.EncodeToString(hash.Sum(nil)), size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Get downloads the file name from the bucket to path
+func (s *s3Store) Get(name string, path string) error {
+	resp, err := s.do("GET", name, nil, nil, s3EmptyHash, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Delete removes the file name from the bucket
+func (s *s3Store) Delete(name string) error {
+	resp, err := s.do("DELETE", name, nil, nil, s3EmptyHash, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// String returns the bucket and prefix as an s3 url
+func (s *s3Store) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// do sends a signed request for the file name in the bucket (or the bucket itself if name is empty),
+// returning an error for responses other than 2xx, and errNotStored for 404 Not Found
+func (s *s3Store) do(method string, name string, query url.Values, body io.Reader, payloadHash string, size int64) (*http.Response, error) {
+	path := "/" + s.bucket + "/"
+	if name != "" {
+		path += s.prefix + name
+	}
+
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup_s3_endpoint %s", err)
+	}
+	u.Path = path
+	u.RawPath = awsEscape(path, false)
+	u.RawQuery = awsQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+
+	signS3Request(req, payloadHash, s.accessKey, s.secretKey, s.region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && name != "" {
+		return nil, errNotStored
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("error from backup store %s %s %s\n%s", method, path, resp.Status, message)
+}
+
+// signS3Request signs req with AWS Signature Version 4 for the s3 service at time t,
+// signing the host and every header set on the request
+func signS3Request(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		awsQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsQuery returns the query sorted by key and escaped as AWS requires
+func awsQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// awsEscape percent encodes every byte of s except unreserved characters, and / unless encodeSlash is true
+func awsEscape(s string, encodeSlash bool) string {
+	escaped := ""
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			escaped += string(c)
+		case c == '/' && !encodeSlash:
+			escaped += "/"
+		default:
+			escaped += fmt.Sprintf("%%%02X", c)
+		}
+	}
+	return escaped
+}
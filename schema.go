@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// The header written at the top of db/schema.sql
+const schemaHeader = "-- Schema generated by fragmenta from the database after migrating, do not edit\n\n"
+
+// readSchema returns the schema of the open database in config as written to db/schema.sql
+func readSchema(config map[string]string) (string, error) {
+	schema, err := dialectFor(config).Schema(config)
+	if err != nil {
+		return "", err
+	}
+	return schemaHeader + schema, nil
+}
+
+// writeSchema writes the schema of the open database in config to db/schema.sql
+func writeSchema(config map[string]string) error {
+	schema, err := readSchema(config)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(dbSchemaPath("."), []byte(schema), permissions)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote schema for db %s to %s", config["db"], dbSchemaPath("."))
+	return nil
+}
+
+// checkSchema compares db/schema.sql with the schema of the open database in config,
+// returning an error describing the first difference if they do not match.
+// It also returns an error if any migrations are pending on the database, as then
+// neither the database nor the file includes the schema changes they make.
+func checkSchema(config map[string]string) error {
+	files, err := readMigrations()
+	if err != nil {
+		return err
+	}
+
+	applied, err := readMetadata(config)
+	if err != nil {
+		return err
+	}
+
+	pending := pendingMigrations(files, applied)
+	if len(pending) > 0 {
+		var names []string
+		for _, m := range pending {
+			names = append(names, m.name)
+		}
+		return fmt.Errorf("%d migrations are pending on db %s, run fragmenta migrate first: %s", len(pending), config["db"], strings.Join(names, ", "))
+	}
+
+	schema, err := readSchema(config)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(dbSchemaPath("."))
+	if err != nil {
+		return err
+	}
+
+	line, expected, found := firstDifference(schema, string(data))
+	if line == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s is out of date with db %s at line %d\ndatabase: %s\nfile:     %s", dbSchemaPath("."), config["db"], line, expected, found)
+}
+
+// firstDifference returns the number of the first line which differs between a and b,
+// along with the line from each, or 0 if they are the same
+func firstDifference(a string, b string) (int, string, string) {
+	linesA := strings.Split(a, "\n")
+	linesB := strings.Split(b, "\n")
+
+	for i := 0; i < len(linesA) || i < len(linesB); i++ {
+		var lineA, lineB string
+		if i < len(linesA) {
+			lineA = linesA[i]
+		}
+		if i < len(linesB) {
+			lineB = linesB[i]
+		}
+		if lineA != lineB || i >= len(linesA) || i >= len(linesB) {
+			return i + 1, lineA, lineB
+		}
+	}
+
+	return 0, "", ""
+}
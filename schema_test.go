@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+var differenceTests = []struct {
+	a, b     string
+	line     int
+	expected string
+	found    string
+}{
+	{"CREATE TABLE pages;\n", "CREATE TABLE pages;\n", 0, "", ""},
+	{"CREATE TABLE pages;\nCREATE TABLE users;\n", "CREATE TABLE pages;\nCREATE TABLE tags;\n", 2, "CREATE TABLE users;", "CREATE TABLE tags;"},
+	{"CREATE TABLE pages;\n", "CREATE TABLE pages;\n\n", 3, "", ""},
+}
+
+// TestFirstDifference tests finding the first line which differs between schemas
+func TestFirstDifference(t *testing.T) {
+	for _, test := range differenceTests {
+		line, expected, found := firstDifference(test.a, test.b)
+		if line != test.line || expected != test.expected || found != test.found {
+			t.Fatalf("Failed to find difference between:%q and:%q result:%d %q %q", test.a, test.b, line, expected, found)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/fragmenta/query"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// The key column used to match seed rows with existing rows if none is declared
+	seedDefaultKey = "id"
+
+	// The prefix for the first line of a csv seed file which declares the key column
+	seedKeyMarker = "# key:"
+)
+
+// seedData holds the rows read from a csv or json seed file,
+// which are inserted or updated in table by matching the key column
+type seedData struct {
+	table string
+	key   string
+	rows  []map[string]interface{}
+}
+
+// seedJSON is the format of json seed files
+type seedJSON struct {
+	Table string                   `json:"table"`
+	Key   string                   `json:"key"`
+	Rows  []map[string]interface{} `json:"rows"`
+}
+
+// validIdentifier matches table and column names which can be used in seed sql without quoting
+var validIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// seedDB loads the seed files in db/seeds/mode into the database in config, in order by name.
+// Sql files are executed as they are, csv and json files are upserted row by row on their key column,
+// so that seeding again updates rows rather than duplicating them. Each file is loaded in one transaction.
+// It returns false if seeding failed.
+func seedDB(config map[string]string, mode string) bool {
+	dir := filepath.Join(dbSeedsPath("."), mode)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		log.Printf("Error reading seeds %s", err)
+		return false
+	}
+
+	// Sort the list alphabetically
+	sort.Strings(files)
+
+	if len(files) == 0 {
+		log.Printf("No seed files found at %s", dir)
+		return true
+	}
+
+	err = openDatabase(config)
+	if err != nil {
+		log.Printf("Error opening database %s", err)
+		return false
+	}
+	defer query.CloseDatabase()
+
+	for _, file := range files {
+		err = seedFile(config, file)
+		if err != nil {
+			log.Printf("ERROR loading seed file %s %s", file, err)
+			log.Printf("All further seeds cancelled\n\n")
+			return false
+		}
+	}
+
+	log.Printf("Seeded db %s from %s\n\n", config["db"], dir)
+	return true
+}
+
+// seedFile loads one seed file into the open database, skipping files of unknown types
+func seedFile(config map[string]string, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var seed *seedData
+	switch filepath.Ext(file) {
+	case ".sql":
+		log.Printf("Running seed %s", file)
+		return execStatements(splitSQL(string(data), dialectFor(config).Name()), true)
+	case ".csv":
+		seed, err = readSeedCSV(file, data)
+	case ".json":
+		seed, err = readSeedJSON(file, data)
+	default:
+		log.Printf("Skipping seed %s - seeds should be sql, csv or json files", file)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Loading %d rows into %s from seed %s", len(seed.rows), seed.table, file)
+
+	d := dialectFor(config)
+	return inTransaction(func() error {
+		ids := false
+		for _, row := range seed.rows {
+			err := upsertSeedRow(d, seed, row)
+			if err != nil {
+				return err
+			}
+			_, ok := row[seedDefaultKey]
+			ids = ids || ok
+		}
+
+		// Rows inserted with ids may leave the id sequence behind them
+		sql := d.ResetSequenceSQL(seed.table, seedDefaultKey)
+		if ids && sql != "" {
+			_, err := query.ExecSQL(sql)
+			return err
+		}
+		return nil
+	})
+}
+
+// readSeedCSV reads a csv seed file, with a header row of column names.
+// The table is taken from the file name, and the key column may be declared
+// with a first line of # key: column. Empty values are loaded as NULL.
+func readSeedCSV(file string, data []byte) (*seedData, error) {
+	seed := &seedData{table: seedTableName(file), key: seedDefaultKey}
+
+	if bytes.HasPrefix(data, []byte(seedKeyMarker)) {
+		line := data
+		i := bytes.IndexByte(data, '\n')
+		if i != -1 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		seed.key = strings.TrimSpace(strings.TrimPrefix(string(line), seedKeyMarker))
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no header row found")
+	}
+
+	columns := records[0]
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(columns))
+		for i, c := range columns {
+			if record[i] == "" {
+				row[c] = nil
+			} else {
+				row[c] = record[i]
+			}
+		}
+		seed.rows = append(seed.rows, row)
+	}
+
+	return seed, seed.validate()
+}
+
+// readSeedJSON reads a json seed file, in the form {"table":"pages","key":"id","rows":[{"id":1}]}
+// The table defaults to that in the file name, and the key to id.
+func readSeedJSON(file string, data []byte) (*seedData, error) {
+	var s seedJSON
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := &seedData{table: s.Table, key: s.Key, rows: s.Rows}
+	if seed.table == "" {
+		seed.table = seedTableName(file)
+	}
+	if seed.key == "" {
+		seed.key = seedDefaultKey
+	}
+
+	// Convert numbers to ints where possible, and store objects and arrays as json
+	for _, row := range seed.rows {
+		for c, v := range row {
+			switch value := v.(type) {
+			case json.Number:
+				i, err := value.Int64()
+				if err == nil {
+					row[c] = i
+				} else {
+					row[c], _ = value.Float64()
+				}
+			case map[string]interface{}, []interface{}:
+				encoded, err := json.Marshal(value)
+				if err != nil {
+					return nil, err
+				}
+				row[c] = string(encoded)
+			}
+		}
+	}
+
+	return seed, seed.validate()
+}
+
+// validate checks the table and columns can be used in sql, and each row has the key column
+func (s *seedData) validate() error {
+	if !validIdentifier.MatchString(s.table) {
+		return fmt.Errorf("invalid table name %q", s.table)
+	}
+
+	for i, row := range s.rows {
+		if _, ok := row[s.key]; !ok {
+			return fmt.Errorf("row %d has no value for key column %s", i+1, s.key)
+		}
+		for c := range row {
+			if !validIdentifier.MatchString(c) {
+				return fmt.Errorf("invalid column name %q", c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// seedTableName returns the table for a seed file from its name, after any ordering prefix
+// e.g. db/seeds/development/01-users.csv loads into users
+func seedTableName(file string) string {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	i := strings.LastIndex(name, "-")
+	if i != -1 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// upsertSeedRow updates the row in the open database with the same key as row,
+// or inserts row if there is none
+func upsertSeedRow(d dialect, seed *seedData, row map[string]interface{}) error {
+	columns := sortedRowKeys(row)
+	update, insert := upsertSQL(d, seed.table, seed.key, columns)
+
+	rows, err := query.QuerySQL(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s=%s;", seed.table, seed.key, d.Placeholder(1)), row[seed.key])
+	if err != nil {
+		return err
+	}
+	count := 0
+	if rows.Next() {
+		err = rows.Scan(&count)
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	var args []interface{}
+	if count == 0 {
+		for _, c := range columns {
+			args = append(args, row[c])
+		}
+		_, err = query.ExecSQL(insert, args...)
+		return err
+	}
+
+	// A row with only a key has nothing to update
+	if update == "" {
+		return nil
+	}
+
+	for _, c := range columns {
+		if c != seed.key {
+			args = append(args, row[c])
+		}
+	}
+	args = append(args, row[seed.key])
+	_, err = query.ExecSQL(update, args...)
+	return err
+}
+
+// upsertSQL returns the sql to update a row in table matched on key, and to insert a row,
+// setting columns in order. Arguments for the update are the columns other than key, then key.
+func upsertSQL(d dialect, table string, key string, columns []string) (string, string) {
+	var sets, placeholders []string
+	for i, c := range columns {
+		placeholders = append(placeholders, d.Placeholder(i+1))
+		if c != key {
+			sets = append(sets, fmt.Sprintf("%s=%s", c, d.Placeholder(len(sets)+1)))
+		}
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);", table, strings.Join(columns, ","), strings.Join(placeholders, ","))
+	if len(sets) == 0 {
+		return "", insert
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET %s WHERE %s=%s;", table, strings.Join(sets, ","), key, d.Placeholder(len(sets)+1))
+	return update, insert
+}
+
+// sortedRowKeys returns the column names in row in order
+func sortedRowKeys(row map[string]interface{}) []string {
+	var keys []string
+	for k := range row {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
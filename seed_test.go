@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestReadSeedCSV tests reading rows and a declared key from csv seeds
+func TestReadSeedCSV(t *testing.T) {
+	data := "# key: email\nemail,name,role\nalice@example.com,Alice,\nbob@example.com,\"Bob, Jr\",admin\n"
+
+	seed, err := readSeedCSV("db/seeds/development/01-users.csv", []byte(data))
+	if err != nil {
+		t.Fatalf("Failed to read csv seed %s", err)
+	}
+
+	if seed.table != "users" || seed.key != "email" || len(seed.rows) != 2 {
+		t.Fatalf("Failed to read csv seed result:%v", seed)
+	}
+
+	if seed.rows[0]["role"] != nil || seed.rows[1]["name"] != "Bob, Jr" {
+		t.Fatalf("Failed to read csv seed values result:%v", seed.rows)
+	}
+
+	_, err = readSeedCSV("users.csv", []byte("name\nAlice\n"))
+	if err == nil {
+		t.Fatalf("Failed to reject csv seed without key column")
+	}
+}
+
+// TestReadSeedJSON tests reading rows from json seeds
+func TestReadSeedJSON(t *testing.T) {
+	data := `{"rows":[{"id":1,"name":"Home","rank":1.5,"tags":["a"],"draft":false}]}`
+
+	seed, err := readSeedJSON("db/seeds/development/pages.json", []byte(data))
+	if err != nil {
+		t.Fatalf("Failed to read json seed %s", err)
+	}
+
+	row := seed.rows[0]
+	if seed.table != "pages" || seed.key != "id" || row["id"] != int64(1) || row["rank"] != 1.5 || row["tags"] != `["a"]` || row["draft"] != false {
+		t.Fatalf("Failed to read json seed result:%v", seed)
+	}
+
+	_, err = readSeedJSON("pages.json", []byte(`{"table":"pages; DROP TABLE users","rows":[]}`))
+	if err == nil {
+		t.Fatalf("Failed to reject invalid table name")
+	}
+}
+
+// TestUpsertSQL tests the sql used to update or insert seed rows
+func TestUpsertSQL(t *testing.T) {
+	update, insert := upsertSQL(&postgresDialect{}, "users", "email", []string{"email", "name", "role"})
+	if update != "UPDATE users SET name=$1,role=$2 WHERE email=$3;" {
+		t.Fatalf("Failed to generate update result:%s", update)
+	}
+	if insert != "INSERT INTO users (email,name,role) VALUES ($1,$2,$3);" {
+		t.Fatalf("Failed to generate insert result:%s", insert)
+	}
+
+	update, _ = upsertSQL(&mysqlDialect{}, "tags", "id", []string{"id"})
+	if update != "" {
+		t.Fatalf("Failed to skip update without columns result:%s", update)
+	}
+}
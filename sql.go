@@ -0,0 +1,183 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// compoundStatement matches the start of mysql and sqlite statements which may hold
+// a BEGIN ... END block of statements, such as trigger bodies
+var compoundStatement = regexp.MustCompile(`(?i)^CREATE\s+(TEMP\s+|TEMPORARY\s+|DEFINER\s*=\s*\S+\s+)?(TRIGGER|PROCEDURE|FUNCTION)\b`)
+
+// splitSQL splits sql for the db adapter into individual statements on semicolons,
+// ignoring semicolons within quoted strings, quoted identifiers,
+// dollar quoted strings (e.g. function bodies), and comments.
+// For mysql, backslashes escape characters in strings, and for mysql and sqlite,
+// semicolons within the BEGIN ... END body of a trigger or procedure are ignored.
+// Statements which contain only comments are dropped.
+func splitSQL(sql string, adapter string) []string {
+	var statements []string
+
+	backslashEscapes := adapter == AdapterMysql
+	blocks := adapter == AdapterMysql || adapter == AdapterSqlite
+
+	start := 0
+	content := false  // true if the current statement has more than comments
+	compound := false // true if the current statement may hold BEGIN ... END blocks
+	depth := 0        // the depth of the blocks within a compound statement
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+
+		switch {
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			// Skip to the end of the line
+			end := strings.IndexByte(sql[i:], '\n')
+			if end == -1 {
+				i = len(sql)
+			} else {
+				i += end
+			}
+
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+
+		case c == '\'':
+			// E'' strings allow backslash escapes
+			escapes := backslashEscapes || i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i == 1 || !isIdentifierByte(sql[i-2]))
+			i = skipQuoted(sql, i, '\'', escapes)
+			content = true
+
+		case c == '"':
+			i = skipQuoted(sql, i, c, backslashEscapes)
+			content = true
+
+		case c == '`':
+			i = skipQuoted(sql, i, c, false)
+			content = true
+
+		case c == '$':
+			tag := dollarTag(sql[i:])
+			if tag != "" && (i == 0 || !isIdentifierByte(sql[i-1])) {
+				end := strings.Index(sql[i+len(tag):], tag)
+				if end == -1 {
+					i = len(sql)
+				} else {
+					i += len(tag) + end + len(tag) - 1
+				}
+			}
+			content = true
+
+		case c == ';' && depth == 0:
+			if content {
+				statements = append(statements, strings.TrimSpace(sql[start:i+1]))
+			}
+			start = i + 1
+			content = false
+			compound = false
+
+		case compound && isIdentifierByte(c) && !isIdentifierByte(sql[i-1]):
+			word := sqlWord(sql[i:])
+			depth = blockDepth(depth, word, sqlWord(strings.TrimLeft(sql[i+len(word):], " \t\r\n")))
+			i += len(word) - 1
+
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			if !content && blocks {
+				compound = compoundStatement.MatchString(sql[i:])
+			}
+			content = true
+		}
+	}
+
+	// Add any final statement without a semicolon
+	if content && start < len(sql) {
+		statements = append(statements, strings.TrimSpace(sql[start:]))
+	}
+
+	return statements
+}
+
+// sqlWord returns the unquoted identifier or keyword at the start of sql
+func sqlWord(sql string) string {
+	for i := 0; i < len(sql); i++ {
+		if !isIdentifierByte(sql[i]) {
+			return sql[:i]
+		}
+	}
+	return sql
+}
+
+// blockDepth returns the depth of BEGIN ... END blocks after word, followed by next.
+// CASE ... END is counted as a block, as its END cannot otherwise be told apart,
+// but the mysql END IF, END LOOP, END REPEAT and END WHILE close statements which are not counted.
+func blockDepth(depth int, word string, next string) int {
+	switch strings.ToUpper(word) {
+	case "BEGIN", "CASE":
+		return depth + 1
+	case "END":
+		switch strings.ToUpper(next) {
+		case "IF", "LOOP", "REPEAT", "WHILE":
+			return depth
+		}
+		if depth > 0 {
+			return depth - 1
+		}
+	}
+	return depth
+}
+
+// skipBlockComment returns the index of the end of the (possibly nested) block comment starting at i
+func skipBlockComment(sql string, i int) int {
+	depth := 0
+	for ; i < len(sql)-1; i++ {
+		if sql[i] == '/' && sql[i+1] == '*' {
+			depth++
+			i++
+		} else if sql[i] == '*' && sql[i+1] == '/' {
+			depth--
+			i++
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(sql)
+}
+
+// skipQuoted returns the index of the closing quote for the quoted string starting at i,
+// a doubled quote is treated as an escaped quote
+func skipQuoted(sql string, i int, quote byte, escapes bool) int {
+	for i++; i < len(sql); i++ {
+		if escapes && sql[i] == '\\' {
+			i++
+			continue
+		}
+		if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return len(sql)
+}
+
+// dollarTag returns the dollar quote tag at the start of sql (e.g. $$ or $body$),
+// or an empty string if there is none (e.g. for a $1 placeholder)
+func dollarTag(sql string) string {
+	for i := 1; i < len(sql); i++ {
+		c := sql[i]
+		if c == '$' {
+			return sql[:i+1]
+		}
+		if !isIdentifierByte(c) || (i == 1 && c >= '0' && c <= '9') {
+			return ""
+		}
+	}
+	return ""
+}
+
+// isIdentifierByte returns true if c can form part of an unquoted identifier
+func isIdentifierByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
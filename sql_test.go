@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+// splitTests maps sql to the statements expected when it is split
+var splitTests = map[string][]string{
+	"CREATE TABLE a (id int);\nDROP TABLE b;":              {"CREATE TABLE a (id int);", "DROP TABLE b;"},
+	"INSERT INTO a VALUES('x;y', 'it''s');":                {"INSERT INTO a VALUES('x;y', 'it''s');"},
+	"SELECT E'\\';' ; SELECT 1":                            {"SELECT E'\\';' ;", "SELECT 1"},
+	"-- comment; here\nSELECT 1;\n/* only; a comment */\n": {"-- comment; here\nSELECT 1;"},
+	"SELECT \"a;b\" FROM t;":                               {"SELECT \"a;b\" FROM t;"},
+	"/* outer /* nested; */ still; */ SELECT 1;":           {"/* outer /* nested; */ still; */ SELECT 1;"},
+	"SELECT $1; SELECT $2;":                                {"SELECT $1;", "SELECT $2;"},
+	`CREATE FUNCTION f() RETURNS trigger AS $$
+BEGIN
+  NEW.updated_at = now();
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+CREATE FUNCTION g() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;`: {
+		"CREATE FUNCTION f() RETURNS trigger AS $$\nBEGIN\n  NEW.updated_at = now();\n  RETURN NEW;\nEND;\n$$ LANGUAGE plpgsql;",
+		"CREATE FUNCTION g() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;",
+	},
+}
+
+// adapterSplitTests maps sql for mysql and sqlite to the statements expected when it is split
+var adapterSplitTests = map[string]map[string][]string{
+	AdapterMysql: {
+		"INSERT INTO a VALUES('it\\'s;', \"a\\\";b\"); SELECT 1;": {"INSERT INTO a VALUES('it\\'s;', \"a\\\";b\");", "SELECT 1;"},
+		"INSERT INTO a VALUES('C:\\\\'); SELECT 1;":               {"INSERT INTO a VALUES('C:\\\\');", "SELECT 1;"},
+		`CREATE DEFINER=CURRENT_USER TRIGGER a_count AFTER INSERT ON a FOR EACH ROW
+BEGIN
+  IF NEW.id > 10 THEN
+    UPDATE counts SET n = n + 1;
+  END IF;
+  UPDATE counts SET total = CASE WHEN total IS NULL THEN 1 ELSE total + 1 END;
+END;
+SELECT 1;`: {
+			"CREATE DEFINER=CURRENT_USER TRIGGER a_count AFTER INSERT ON a FOR EACH ROW\nBEGIN\n  IF NEW.id > 10 THEN\n    UPDATE counts SET n = n + 1;\n  END IF;\n  UPDATE counts SET total = CASE WHEN total IS NULL THEN 1 ELSE total + 1 END;\nEND;",
+			"SELECT 1;",
+		},
+	},
+	AdapterSqlite: {
+		"INSERT INTO a VALUES('C:\\'); SELECT 1;": {"INSERT INTO a VALUES('C:\\');", "SELECT 1;"},
+		`CREATE TEMP TRIGGER a_updated AFTER UPDATE ON a
+BEGIN
+  UPDATE a SET updated_at = 'now;' WHERE id = NEW.id; -- end;
+  INSERT INTO log VALUES(CASE WHEN NEW.end_at IS NULL THEN 'open' END);
+END;
+BEGIN;
+CREATE TABLE events (begin text, end text);
+COMMIT;`: {
+			"CREATE TEMP TRIGGER a_updated AFTER UPDATE ON a\nBEGIN\n  UPDATE a SET updated_at = 'now;' WHERE id = NEW.id; -- end;\n  INSERT INTO log VALUES(CASE WHEN NEW.end_at IS NULL THEN 'open' END);\nEND;",
+			"BEGIN;",
+			"CREATE TABLE events (begin text, end text);",
+			"COMMIT;",
+		},
+	},
+}
+
+// TestSplitSQL tests splitting sql into statements
+func TestSplitSQL(t *testing.T) {
+	tests := map[string]map[string][]string{AdapterPostgres: splitTests}
+	for adapter, adapterTests := range adapterSplitTests {
+		tests[adapter] = adapterTests
+	}
+
+	for adapter, adapterTests := range tests {
+		for sql, expected := range adapterTests {
+			statements := splitSQL(sql, adapter)
+			if len(statements) != len(expected) {
+				t.Fatalf("Failed to split %s sql:%s\nexpected:%q\nresult:%q", adapter, sql, expected, statements)
+			}
+			for i := range expected {
+				if statements[i] != expected[i] {
+					t.Fatalf("Failed to split %s sql:%s\nexpected:%q\nresult:%q", adapter, sql, expected, statements)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fragmenta/query"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// The folder within db/migrate which squashed migrations are moved to
+	migrationArchiveFolder = "archive"
+
+	// The suffix of baseline migration names, after the name of the last migration squashed
+	baselineSuffix = "-Baseline.sql"
+
+	// The suffix added to the database name for the scratch database baselines are dumped from
+	squashScratchSuffix = "_squash"
+)
+
+// squashMigrations replaces the migrations before version with one baseline migration
+// containing their schema, records the baseline as applied in place of them,
+// and moves their files to db/migrate/archive. Migrations which create the database are kept.
+// The schema is dumped from a scratch database migrated up to version, so the database in config
+// may have later migrations applied, but must have every migration before version applied.
+// With options.dryRun the scratch database is not created, so the plan printed omits the schema.
+// It returns true if the migrations were squashed.
+func squashMigrations(config map[string]string, version string, options migrateOptions) bool {
+
+	files, err := readMigrations()
+	if err != nil {
+		log.Printf("Error reading migrations %s", err)
+		return false
+	}
+
+	before, err := matchMigration(version, files)
+	if err != nil {
+		log.Printf("Error finding migration %s", err)
+		return false
+	}
+
+	var squashed []*migration
+	for _, m := range files {
+		if m.name < before.name && !m.createsDatabase() {
+			squashed = append(squashed, m)
+		}
+	}
+
+	if len(squashed) == 0 {
+		log.Printf("No migrations to squash before %s", before.name)
+		return false
+	}
+
+	last := squashed[len(squashed)-1]
+	schema := fmt.Sprintf("-- The schema dumped from scratch db %s migrated to %s\n", scratchConfig(config)["db"], last.name)
+	if !options.dryRun {
+		schema, err = scratchSchema(config, last, options)
+		if err != nil {
+			log.Printf("Error reading schema %s", err)
+			return false
+		}
+	}
+
+	err = openDatabase(config)
+	if err != nil {
+		log.Printf("Error opening database %s", err)
+		return false
+	}
+	defer query.CloseDatabase()
+
+	if !options.dryRun {
+		err = lockMigrations(config)
+		if err != nil {
+			log.Printf("ERROR locking migrations: %s", err)
+			return false
+		}
+		defer unlockMigrations(config)
+	}
+
+	// The baseline is recorded in place of the migrations squashed, so they must all be applied
+	applied, err := readMetadata(config)
+	if err != nil {
+		log.Printf("Error reading migrations applied %s", err)
+		return false
+	}
+	for _, m := range squashed {
+		if !contains(m.name, applied) {
+			log.Printf("Error squashing migrations - %s has not been applied to db %s, run fragmenta migrate first", m.name, config["db"])
+			return false
+		}
+	}
+
+	baseline := baselineMigration(config, last, squashed, schema)
+
+	if options.dryRun {
+		fmt.Printf("-- Baseline migration %s\n%s\n", baseline.path, baseline.up)
+		fmt.Printf("-- Record the baseline in place of the squashed migrations\nBEGIN;\n%sCOMMIT;\n", baselineRecordPlan(config, baseline))
+		for _, m := range squashed {
+			fmt.Printf("-- Move %s to %s\n", m.path, filepath.Join(dbMigratePath("."), migrationArchiveFolder))
+		}
+		return true
+	}
+
+	err = ioutil.WriteFile(baseline.path, []byte(baseline.up), permissions)
+	if err != nil {
+		log.Printf("Error writing baseline migration %s", err)
+		return false
+	}
+
+	err = recordBaseline(config, baseline, options)
+	if err != nil {
+		log.Printf("ERROR recording baseline migration %s", err)
+		os.Remove(baseline.path)
+		return false
+	}
+
+	err = archiveMigrations(squashed)
+	if err != nil {
+		log.Printf("Error archiving migrations %s", err)
+		return false
+	}
+
+	log.Printf("Squashed %d migrations into %s on db %s\n\n", len(squashed), baseline.path, config["db"])
+	return true
+}
+
+// scratchSchema returns the schema of the migrations up to and including last, dumped from a scratch
+// database beside the database in config, which is created, migrated and then dropped
+func scratchSchema(config map[string]string, last *migration, options migrateOptions) (string, error) {
+	scratch := scratchConfig(config)
+	log.Printf("Migrating scratch db %s to %s", scratch["db"], last.name)
+
+	// Remove any scratch database left by an earlier squash
+	if !dropDB(scratch) || !createDB(scratch) {
+		return "", fmt.Errorf("could not create scratch db %s", scratch["db"])
+	}
+	defer func() {
+		query.CloseDatabase()
+		dropDB(scratch)
+	}()
+
+	if !migrateDB(scratch, migrateOptions{to: last.name, psql: options.psql}) {
+		return "", fmt.Errorf("could not migrate scratch db %s", scratch["db"])
+	}
+
+	err := reopenDatabase(scratch)
+	if err != nil {
+		return "", err
+	}
+	return dialectFor(scratch).Schema(scratch)
+}
+
+// scratchConfig returns a copy of config for the scratch database beside the database in config
+func scratchConfig(config map[string]string) map[string]string {
+	scratch := make(map[string]string, len(config))
+	for k, v := range config {
+		scratch[k] = v
+	}
+
+	// Sqlite databases are files, so keep the extension
+	ext := ""
+	if dialectFor(config).Name() == AdapterSqlite {
+		ext = filepath.Ext(config["db"])
+	}
+	scratch["db"] = strings.TrimSuffix(config["db"], ext) + squashScratchSuffix + ext
+	return scratch
+}
+
+// missingSquashed returns the migrations replaced by a baseline which are not in applied.
+// Migrations replaced by an earlier baseline which has been applied are not missing,
+// and neither are earlier baselines whose migrations have all been applied.
+func missingSquashed(squashed []string, applied []string) []string {
+	// Baselines are listed after the migrations they replaced
+	start := 0
+	for i, name := range squashed {
+		if strings.HasSuffix(name, baselineSuffix) && contains(name, applied) {
+			start = i + 1
+		}
+	}
+
+	var missing []string
+	for _, name := range squashed[start:] {
+		if !strings.HasSuffix(name, baselineSuffix) && !contains(name, applied) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// baselineMigration returns a migration with the schema given which replaces the migrations squashed,
+// named to sort directly after the last of them. Migrations replaced by earlier baselines are carried over,
+// so that databases migrated before any squash recognise the new baseline. The schema does not include
+// fragmenta_metadata, so it is created first for new databases, as the migration which created it is squashed.
+func baselineMigration(config map[string]string, last *migration, squashed []*migration, schema string) *migration {
+	name := strings.TrimSuffix(strings.TrimSuffix(last.name, ".sql"), ".go") + baselineSuffix
+
+	var names []string
+	for _, m := range squashed {
+		names = append(names, m.squashed...)
+		names = append(names, m.name)
+	}
+
+	content := "-- Baseline schema generated by fragmenta migrate squash\n"
+	for _, n := range names {
+		content += migrationSquashedMarker + n + "\n"
+	}
+	content += "\n" + metadataTableSQL(config) + "\n" + schema
+
+	m := parseMigration(name, content)
+	m.path = filepath.Join(dbMigratePath("."), name)
+	m.checksum = checksum([]byte(content))
+	return m
+}
+
+// baselineRecordPlan returns the sql to record this baseline in fragmenta_metadata,
+// and remove the records of the migrations it replaced
+func baselineRecordPlan(config map[string]string, m *migration) string {
+	sql := insertMetadataPlan(config, m)
+	for _, name := range m.squashed {
+		sql += deleteMetadataPlan(&migration{name: name})
+	}
+	return sql
+}
+
+// recordBaseline records this baseline as applied on the open database, in place of
+// the migrations it replaced, without running the baseline sql
+func recordBaseline(config map[string]string, m *migration, options migrateOptions) error {
+	record := baselineRecordPlan(config, m)
+
+	if options.psql {
+		return runPsql("BEGIN;\n"+record+"COMMIT;", "-d", config["db"])
+	}
+
+	var statements []string
+	if dialectFor(config).AddColumnSQL("fragmenta_metadata", "checksum", "text") == "" {
+		statements = append(statements, upgradeMetadataSQL(config)...)
+	}
+	statements = append(statements, splitSQL(record, dialectFor(config).Name())...)
+
+	return execStatements(statements, true)
+}
+
+// archiveMigrations moves the files for migrations (including paired down files) to db/migrate/archive
+func archiveMigrations(migrations []*migration) error {
+	archive := filepath.Join(dbMigratePath("."), migrationArchiveFolder)
+	err := os.MkdirAll(archive, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		paths := []string{m.path}
+		downPath := strings.TrimSuffix(m.path, ".sql") + migrationDownSuffix
+		if strings.HasSuffix(m.path, ".sql") && fileExists(downPath) {
+			paths = append(paths, downPath)
+		}
+
+		for _, p := range paths {
+			err = os.Rename(p, filepath.Join(archive, filepath.Base(p)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
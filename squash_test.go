@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBaselineMigration tests creating a baseline migration from squashed migrations
+func TestBaselineMigration(t *testing.T) {
+	earlier := parseMigration("2016-01-01-120000-Create-Users-Baseline.sql", "-- +squashed 2016-01-01-120000-Create-Users.sql\nCREATE TABLE users (id int);\n")
+	pages := parseMigration("2016-01-02-150405-Create-Pages.sql", "CREATE TABLE pages (id int);\n")
+
+	m := baselineMigration(map[string]string{}, pages, []*migration{earlier, pages}, "CREATE TABLE users (id int);\nCREATE TABLE pages (id int);\n")
+	if m.name != "2016-01-02-150405-Create-Pages-Baseline.sql" {
+		t.Fatalf("Failed to name baseline migration result:%s", m.name)
+	}
+
+	squashed := []string{"2016-01-01-120000-Create-Users.sql", "2016-01-01-120000-Create-Users-Baseline.sql", "2016-01-02-150405-Create-Pages.sql"}
+	if strings.Join(m.squashed, ",") != strings.Join(squashed, ",") {
+		t.Fatalf("Failed to list squashed migrations result:%v", m.squashed)
+	}
+
+	if len(splitSQL(m.up, AdapterPostgres)) != 3 || !strings.Contains(m.up, "CREATE TABLE IF NOT EXISTS fragmenta_metadata") || m.canRevert() || m.checksum != checksum([]byte(m.up)) {
+		t.Fatalf("Failed to parse baseline migration result:\n%s", m.up)
+	}
+
+	plan := baselineRecordPlan(map[string]string{}, m)
+	if strings.Count(plan, "DELETE FROM fragmenta_metadata") != 3 || !strings.Contains(plan, "'2016-01-02-150405-Create-Pages-Baseline.sql'") {
+		t.Fatalf("Failed to plan baseline record result:\n%s", plan)
+	}
+}
+
+// TestBaselineSqlite tests applying a baseline and recording it on an empty sqlite database
+func TestBaselineSqlite(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "fragmenta-squash")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := map[string]string{"db_adapter": AdapterSqlite, "db": filepath.Join(dir, "app.sqlite")}
+	pages := parseMigration("2016-01-02-150405-Create-Pages.sql", "")
+	m := baselineMigration(config, pages, []*migration{pages}, "CREATE TABLE pages (id INTEGER PRIMARY KEY, name text);\n")
+
+	sql := "BEGIN;\n" + m.up + insertMetadataPlan(config, m) + "COMMIT;\n"
+	cmd := exec.Command("sqlite3", "-bail", config["db"])
+	cmd.Stdin = strings.NewReader(sql)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to apply baseline %s\n%s\n%s", err, output, sql)
+	}
+
+	output, err = exec.Command("sqlite3", config["db"], "SELECT migration_version FROM fragmenta_metadata;").CombinedOutput()
+	if err != nil || strings.TrimSpace(string(output)) != m.name {
+		t.Fatalf("Failed to record baseline %v result:%s", err, output)
+	}
+}
+
+// TestMissingSquashed tests finding migrations replaced by a baseline which have not been applied
+func TestMissingSquashed(t *testing.T) {
+	// A baseline of a and b, then a second baseline of that and c
+	squashed := []string{"a.sql", "b.sql", "b" + baselineSuffix, "c.sql"}
+
+	tests := []struct {
+		applied []string
+		missing string
+	}{
+		{[]string{"a.sql", "b.sql", "c.sql"}, ""},
+		{[]string{"b" + baselineSuffix, "c.sql"}, ""},
+		{[]string{"a.sql", "c.sql"}, "b.sql"},
+		{[]string{"b" + baselineSuffix}, "c.sql"},
+		{[]string{"a.sql"}, "b.sql,c.sql"},
+	}
+
+	for _, test := range tests {
+		missing := strings.Join(missingSquashed(squashed, test.applied), ",")
+		if missing != test.missing {
+			t.Fatalf("Failed to find missing migrations for %v expected:%s result:%s", test.applied, test.missing, missing)
+		}
+	}
+}
+
+// TestScratchConfig tests naming the scratch database squash dumps the schema from
+func TestScratchConfig(t *testing.T) {
+	if db := scratchConfig(map[string]string{"db": "app_development"})["db"]; db != "app_development_squash" {
+		t.Fatalf("Failed to name postgres scratch db result:%s", db)
+	}
+	if db := scratchConfig(map[string]string{"db_adapter": AdapterSqlite, "db": "db/app.sqlite"})["db"]; db != "db/app_squash.sqlite" {
+		t.Fatalf("Failed to name sqlite scratch db result:%s", db)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// errNotStored is returned when a file is not found in a backup store
+var errNotStored = errors.New("file not found in backup store")
+
+// storedFile is a file held in a backup store
+type storedFile struct {
+	// The name of the file in the store, for local stores this is its path
+	name string
+	// The size of the file in bytes
+	size int64
+}
+
+// backupStore is a place to keep backup archives and their manifests,
+// set for each mode by backup_store in config
+type backupStore interface {
+	// List returns the files in the store
+	List() ([]storedFile, error)
+
+	// Put copies the local file at path into the store, named by its file name
+	Put(path string) error
+
+	// Get copies the file name in the store to the local file at path,
+	// returning errNotStored if it does not exist
+	Get(name string, path string) error
+
+	// Delete removes the file name from the store
+	Delete(name string) error
+
+	// String describes the store for display
+	String() string
+}
+
+// backupStoreFor returns the store for backups set in config, by default the local folder db/backup
+func backupStoreFor(config map[string]string) (backupStore, error) {
+	switch config["backup_store"] {
+	case "", "local":
+		dir := config["backup_dir"]
+		if dir == "" {
+			dir = dbBackupPath(".")
+		}
+		return &localStore{dir: dir}, nil
+	case "s3":
+		return newS3Store(config)
+	default:
+		return nil, fmt.Errorf("unknown backup_store %q - use local or s3", config["backup_store"])
+	}
+}
+
+// localStore keeps backups in a folder on the local filesystem
+type localStore struct {
+	dir string
+}
+
+// List returns the files in the folder
+func (s *localStore) List() ([]storedFile, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []storedFile
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		files = append(files, storedFile{name: p, size: info.Size()})
+	}
+	return files, nil
+}
+
+// Put copies the file at path into the folder, unless it is already there
+func (s *localStore) Put(path string) error {
+	return copyLocalFile(path, filepath.Join(s.dir, filepath.Base(path)))
+}
+
+// Get copies the file name to path, unless it is already there
+func (s *localStore) Get(name string, path string) error {
+	if !fileExists(name) {
+		return errNotStored
+	}
+	return copyLocalFile(name, path)
+}
+
+// Delete removes the file name
+func (s *localStore) Delete(name string) error {
+	return os.Remove(name)
+}
+
+// String returns the folder
+func (s *localStore) String() string {
+	return s.dir
+}
+
+// copyLocalFile copies the file at src to dst, unless they are the same file
+func copyLocalFile(src string, dst string) error {
+	if filepath.Clean(src) == filepath.Clean(dst) {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// stagingPath returns the local path where the archive named name is written before it is
+// stored, or read after it is fetched - within the folder for local stores, otherwise in db/backup
+func stagingPath(store backupStore, name string) string {
+	if s, ok := store.(*localStore); ok {
+		return filepath.Join(s.dir, filepath.Base(name))
+	}
+	return filepath.Join(dbBackupPath("."), filepath.Base(name))
+}
+
+// storeBackup puts the archive at path and its manifest into store,
+// then removes the local copies if they are not kept in the store itself
+func storeBackup(store backupStore, path string) error {
+	// Local stores are written to directly
+	if _, ok := store.(*localStore); ok {
+		return nil
+	}
+
+	for _, p := range []string{path, manifestPath(path)} {
+		err := store.Put(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	os.Remove(path)
+	os.Remove(manifestPath(path))
+	return nil
+}
+
+// fetchBackup returns a local path for the archive name in store, with its manifest beside it if it has one,
+// downloading them if the store is not local. The cleanup function removes any files downloaded.
+func fetchBackup(store backupStore, name string) (string, func(), error) {
+	if _, ok := store.(*localStore); ok {
+		return name, func() {}, nil
+	}
+
+	path := stagingPath(store, name)
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cleanup := func() {
+		os.Remove(path)
+		os.Remove(manifestPath(path))
+	}
+
+	err = store.Get(name, path)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	err = store.Get(manifestPath(name), manifestPath(path))
+	if err != nil && err != errNotStored {
+		cleanup()
+		return "", nil, err
+	}
+
+	return path, cleanup, nil
+}
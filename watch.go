@@ -0,0 +1,277 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// How often watched files are checked for changes
+	watchInterval = 500 * time.Millisecond
+
+	// How long files must be unchanged before rebuilding, so that a burst of saves causes one build
+	watchDebounce = 300 * time.Millisecond
+
+	// How long the server has to stop after an interrupt before it is killed
+	serverStopTimeout = 5 * time.Second
+)
+
+// The extensions of files watched outside assets folders - go code and view templates
+var watchExtensions = []string{".go", ".got"}
+
+// watchedFile records the state of a watched file, to detect changes
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// RunWatchServer builds and runs the server, then watches src, server.go and the view templates,
+// rebuilding and restarting the server when go code changes. If a build fails, the compiler errors
+// are printed and the old server keeps running until the next successful build.
+// Browsers with the live reload script are reloaded after a restart, or without a rebuild when only
+// templates or assets change, in which case assets are recompiled and stylesheets reloaded in place.
+func RunWatchServer(projectPath string) {
+	ShowVersion()
+
+	reload := newLiveReload()
+	reload.listen(liveReloadAddress(ConfigDevelopment))
+
+	paths := []string{srcPath(projectPath), serverCompilePath(projectPath)}
+	log.Printf("Watching %v for changes", paths)
+
+	files, err := scanFiles(paths)
+	if err != nil {
+		log.Printf("Error watching files %s", err)
+		return
+	}
+
+	server := rebuildServer(projectPath, nil)
+
+	var changed []string
+	var lastChange time.Time
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		var exited <-chan error
+		if server != nil {
+			exited = server.done
+		}
+
+		select {
+		case err := <-exited:
+			log.Printf("Server exited %v, waiting for changes", err)
+			server = nil
+		case <-ticker.C:
+			current, err := scanFiles(paths)
+			if err != nil {
+				log.Printf("Error watching files %s", err)
+				continue
+			}
+
+			c := changedFiles(files, current)
+			files = current
+			if len(c) > 0 {
+				changed = append(changed, c...)
+				lastChange = time.Now()
+				continue
+			}
+
+			// Wait until changes stop before rebuilding
+			if len(changed) == 0 || time.Since(lastChange) < watchDebounce {
+				continue
+			}
+
+			log.Printf("Files changed: %v", changed)
+			server = handleChanges(projectPath, server, changed, reload)
+			changed = nil
+
+			// Ignore changes made by go fmt during the build
+			files, _ = scanFiles(paths)
+		}
+	}
+}
+
+// handleChanges rebuilds the server if go code has changed, otherwise recompiles any assets changed,
+// then tells browsers to reload. It returns the server now running.
+func handleChanges(projectPath string, server *devServer, changed []string, reload *liveReload) *devServer {
+	assetsChanged := false
+	for _, path := range changed {
+		switch changeKind(path) {
+		case changeCode:
+			running := server
+			server = rebuildServer(projectPath, server)
+			// Reload once the new server is accepting requests
+			if server != nil && server != running {
+				if waitForServer("localhost:"+ConfigDevelopment["port"], serverStopTimeout) {
+					reload.notify(reloadPage)
+				}
+			}
+			return server
+		case changeAsset:
+			assetsChanged = true
+		}
+	}
+
+	if assetsChanged {
+		log.Println("Compiling assets...")
+		err := compileAssets(ConfigDevelopment["assets_compiled"] == "yes")
+		if err != nil {
+			log.Printf("Error compiling assets %s", err)
+			return server
+		}
+	}
+
+	reload.notify(reloadFor(changed))
+	return server
+}
+
+// rebuildServer builds the server, and if the build succeeds stops the running server
+// (if any) and starts the new one. If the build fails, running is left running.
+func rebuildServer(projectPath string, running *devServer) *devServer {
+	log.Println("Building server...")
+
+	// Build beside the running binary, so that it is kept if the build fails
+	next := localServerPath(projectPath) + "-next"
+	err := buildServer(next, nil)
+	if err != nil {
+		if running != nil {
+			log.Printf("Error building server, the old server is still running: %s", err)
+		} else {
+			log.Printf("Error building server: %s", err)
+		}
+		return running
+	}
+
+	if running != nil {
+		log.Println("Stopping server...")
+		err = running.stop()
+		if err != nil {
+			log.Printf("Error stopping server %s", err)
+		}
+	}
+
+	err = os.Rename(next, localServerPath(projectPath))
+	if err != nil {
+		log.Printf("Error moving server %s", err)
+		return nil
+	}
+
+	log.Println("Launching server...")
+	server, err := startServer(localServerPath(projectPath))
+	if err != nil {
+		log.Printf("Error launching server %s", err)
+		return nil
+	}
+	return server
+}
+
+// devServer is a server process started by the watcher
+type devServer struct {
+	cmd *exec.Cmd
+	// Receives the result of the process once it exits
+	done chan error
+}
+
+// startServer starts command with the output sent to our own
+func startServer(command string, args ...string) (*devServer, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &devServer{cmd: cmd, done: make(chan error, 1)}
+	go func() {
+		s.done <- cmd.Wait()
+	}()
+	return s, nil
+}
+
+// stop interrupts the server so that it can shut down gracefully,
+// and kills it if it has not exited after serverStopTimeout
+func (s *devServer) stop() error {
+	// Windows does not support sending interrupts
+	if isWindows() {
+		s.cmd.Process.Kill()
+		<-s.done
+		return nil
+	}
+
+	err := s.cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		// The process has already exited
+		<-s.done
+		return nil
+	}
+
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(serverStopTimeout):
+		log.Printf("Server did not stop after %s, killing it", serverStopTimeout)
+		err = s.cmd.Process.Kill()
+		<-s.done
+		return err
+	}
+}
+
+// scanFiles returns the state of the files with watched extensions or in assets folders at or below paths
+func scanFiles(paths []string) (map[string]watchedFile, error) {
+	files := make(map[string]watchedFile)
+
+	for _, root := range paths {
+		if !fileExists(root) {
+			continue
+		}
+
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Files may be removed while we walk
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if info.IsDir() || (!contains(filepath.Ext(path), watchExtensions) && changeKind(path) != changeAsset) {
+				return nil
+			}
+
+			files[path] = watchedFile{modTime: info.ModTime(), size: info.Size()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// changedFiles returns the paths of files added, removed or changed between before and after, in order
+func changedFiles(before map[string]watchedFile, after map[string]watchedFile) []string {
+	var changed []string
+
+	for path, f := range after {
+		if b, ok := before[path]; !ok || b != f {
+			changed = append(changed, path)
+		}
+	}
+
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
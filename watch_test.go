@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestChangedFiles tests detecting changes to watched files
+func TestChangedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fragmenta-watch")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	views := filepath.Join(dir, "src", "pages", "views")
+	os.MkdirAll(views, os.ModePerm)
+	server := filepath.Join(dir, "server.go")
+	ioutil.WriteFile(server, []byte("package main"), 0644)
+	ioutil.WriteFile(filepath.Join(views, "show.html.got"), []byte("<h1>"), 0644)
+	ioutil.WriteFile(filepath.Join(views, "notes.txt"), []byte("notes"), 0644)
+
+	paths := []string{filepath.Join(dir, "src"), server, filepath.Join(dir, "missing")}
+	before, err := scanFiles(paths)
+	if err != nil || len(before) != 2 {
+		t.Fatalf("Failed to scan files %v %s", before, err)
+	}
+
+	// Change, add and remove files, and change one which is not watched
+	ioutil.WriteFile(server, []byte("package main\n"), 0644)
+	ioutil.WriteFile(filepath.Join(views, "index.html.got"), []byte("<ul>"), 0644)
+	os.Remove(filepath.Join(views, "show.html.got"))
+	ioutil.WriteFile(filepath.Join(views, "notes.txt"), []byte("more notes"), 0644)
+
+	after, err := scanFiles(paths)
+	if err != nil {
+		t.Fatalf("Failed to scan files %s", err)
+	}
+
+	changed := changedFiles(before, after)
+	expected := []string{server, filepath.Join(views, "index.html.got"), filepath.Join(views, "show.html.got")}
+	if strings.Join(changed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Failed to detect changes expected:%v result:%v", expected, changed)
+	}
+
+	if len(changedFiles(after, after)) != 0 {
+		t.Fatalf("Failed to ignore unchanged files")
+	}
+}
+
+// TestStopServer tests stopping a running server with an interrupt
+func TestStopServer(t *testing.T) {
+	if isWindows() {
+		t.Skip("sleep is not available on windows")
+	}
+
+	s, err := startServer("sleep", "10")
+	if err != nil {
+		t.Fatalf("Failed to start server %s", err)
+	}
+
+	started := time.Now()
+	err = s.stop()
+	if err != nil || time.Since(started) > serverStopTimeout {
+		t.Fatalf("Failed to stop server %s", err)
+	}
+}